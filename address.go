@@ -9,7 +9,15 @@ import (
 	"github.com/pkg/errors"
 )
 
-var addrTable = addrSpace{slots: newSlotTable()}
+var addrTable = addrSpace{slots: newSlotTable(), bound: make(map[ID][]string)}
+
+var (
+	// ErrAddrInUse is returned when binding to an address that is already bound
+	ErrAddrInUse = errors.New("address in use")
+
+	// ErrUnboundAddr is returned when connecting to an address that is not bound
+	ErrUnboundAddr = errors.New("unbound address")
+)
 
 type boundEndpoint interface {
 	Endpoint
@@ -41,6 +49,7 @@ func (s *slotTable) Del(slot string) { (*radix.Tree)(unsafe.Pointer(s)).Delete(s
 type addrSpace struct {
 	sync.RWMutex
 	slots *slotTable
+	bound map[ID][]string // addresses assigned to each endpoint
 }
 
 func (a *addrSpace) Assign(addr string, ep boundEndpoint) (err error) {
@@ -48,31 +57,68 @@ func (a *addrSpace) Assign(addr string, ep boundEndpoint) (err error) {
 	defer a.Unlock()
 
 	if a.slots.Occupied(addr) {
-		err = errors.New("address in use")
+		err = ErrAddrInUse
 	} else {
 		a.slots.Insert(addr, ep)
-		ctx.Defer(ep, a.releaseSlot(addr))
+		a.bound[ep.ID()] = append(a.bound[ep.ID()], addr)
+		ctx.Defer(ep, a.releaseSlot(addr, ep))
 	}
 
 	return
 }
 
+// Release the slots assigned to ep.  Portals release their slots when they
+// are closed, so that their addresses can be bound again as soon as Close
+// returns.  Portals whose Doner expires release them asynchronously.
+func (a *addrSpace) Release(ep Endpoint) {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, addr := range a.bound[ep.ID()] {
+		a.slots.Del(addr)
+	}
+	delete(a.bound, ep.ID())
+}
+
 func (a *addrSpace) Lookup(addr string) (ep boundEndpoint, err error) {
 	a.RLock()
 	defer a.RUnlock()
 
 	var ok bool
 	if ep, ok = a.slots.Get(addr); !ok {
-		err = errors.New("unbound address")
+		err = ErrUnboundAddr
 	}
 
 	return
 }
 
-func (a *addrSpace) releaseSlot(addr string) func() {
+// releaseSlot returns a function that releases the slot, unless it was
+// reassigned in the meantime
+func (a *addrSpace) releaseSlot(addr string, ep boundEndpoint) func() {
 	return func() {
 		a.Lock()
-		a.slots.Del(addr)
-		a.Unlock()
+		defer a.Unlock()
+
+		if cur, ok := a.slots.Get(addr); ok && cur == ep {
+			a.slots.Del(addr)
+			a.unbind(ep.ID(), addr)
+		}
+	}
+}
+
+// unbind removes addr from the addresses assigned to the endpoint
+func (a *addrSpace) unbind(id ID, addr string) {
+	addrs := a.bound[id]
+	for i, bound := range addrs {
+		if bound == addr {
+			addrs = append(addrs[:i], addrs[i+1:]...)
+			break
+		}
+	}
+
+	if len(addrs) == 0 {
+		delete(a.bound, id)
+	} else {
+		a.bound[id] = addrs
 	}
 }
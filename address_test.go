@@ -1,7 +1,74 @@
 package portal
 
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 // func TestTransport(t *testing.T) {
 // }
 
 // t.Run("", func(t *testing.T) {
 // })
+
+func TestAddrErrors(t *testing.T) {
+	ptl, cancel := mkSendRecvTestPortal(mockProto{}, 0)
+	defer cancel()
+
+	if err := ptl.Bind("/addr/in/use"); err != nil {
+		t.Errorf("failed to bind: %s", err)
+	}
+
+	t.Run("AddrInUse", func(t *testing.T) {
+		p, cancel := mkSendRecvTestPortal(mockProto{}, 0)
+		defer cancel()
+
+		if err := p.Bind("/addr/in/use"); errors.Cause(err) != ErrAddrInUse {
+			t.Errorf("expected %s, got %v", ErrAddrInUse, err)
+		}
+	})
+
+	t.Run("UnboundAddr", func(t *testing.T) {
+		p, cancel := mkSendRecvTestPortal(mockProto{}, 0)
+		defer cancel()
+
+		if err := p.Connect("/addr/unbound"); errors.Cause(err) != ErrUnboundAddr {
+			t.Errorf("expected %s, got %v", ErrUnboundAddr, err)
+		}
+	})
+}
+
+func TestRebind(t *testing.T) {
+	ptl, _ := mkSendRecvTestPortal(mockProto{}, 0)
+	for _, addr := range []string{"/addr/rebind", "/addr/rebind/other"} {
+		if err := ptl.Bind(addr); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+	}
+	ptl.Close()
+
+	if _, err := addrTable.Lookup("/addr/rebind/other"); err != ErrUnboundAddr {
+		t.Errorf("expected %s, got %v", ErrUnboundAddr, err)
+	}
+
+	p, cancel := mkSendRecvTestPortal(mockProto{}, 0)
+	defer cancel()
+
+	if err := p.Bind("/addr/rebind"); err != nil {
+		t.Errorf("failed to bind after the previous portal was closed: %s", err)
+	}
+
+	time.Sleep(time.Millisecond) // the previous portal's slot is released
+	if ep, err := addrTable.Lookup("/addr/rebind"); err != nil || ep != p {
+		t.Errorf("slot was released by the previous portal (%v)", err)
+	}
+
+	addrTable.RLock()
+	defer addrTable.RUnlock()
+
+	if addrs, ok := addrTable.bound[ptl.ID()]; ok {
+		t.Errorf("closed portal still holds addresses %v", addrs)
+	}
+}
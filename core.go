@@ -1,25 +1,112 @@
 package portal
 
 import (
+	"context"
+	"sync/atomic"
+	"time"
+
 	"github.com/SentimensRG/ctx"
 	"github.com/SentimensRG/ctx/sigctx"
 	"github.com/pkg/errors"
 )
 
+var (
+	// ErrClosed is returned when an operation is attempted on (or interrupted
+	// by) a closed portal
+	ErrClosed = errors.New("portal closed")
+
+	// ErrNotConnected is returned when an operation is attempted on a portal
+	// that has neither been bound nor connected to an address
+	ErrNotConnected = errors.New("portal not connected")
+)
+
+// Overflow determines what happens when a message is sent to a full queue
+type Overflow uint8
+
+const (
+	// Block until the queue has room for the message.  This is the default.
+	Block Overflow = iota
+
+	// DropNewest discards the message being sent
+	DropNewest
+
+	// DropOldest discards the oldest message in the queue to make room for the
+	// message being sent
+	DropOldest
+
+	// Callback discards the message being sent after passing it to Cfg.OnDrop
+	Callback
+)
+
 // Cfg is a base configuration struct
 type Cfg struct {
 	ctx.Doner
 	Size int
+
+	// Overflow policy applied when a buffered queue is full.  It is applied by
+	// the core to the portal's send queue, and by fan-out protocols to the
+	// per-peer queues they maintain.  Unbuffered queues always Block.
+	Overflow Overflow
+
+	// OnDrop is called with each message discarded by the Callback policy.  The
+	// message is freed when OnDrop returns, so it MUST NOT be retained.
+	OnDrop func(*Message)
 }
 
 // Async returns true if the Portal is buffered
 func (c Cfg) Async() bool { return c.Size > 0 }
 
+// Enqueue sends msg on q, applying the Overflow policy if q is full.  It
+// returns false if the message was dropped or if cq fired before the message
+// could be enqueued.  In either case, msg is freed.
+func (c Cfg) Enqueue(q chan *Message, msg *Message, cq <-chan struct{}) bool {
+	if c.Overflow == Block || cap(q) == 0 {
+		select {
+		case q <- msg:
+			return true
+		case <-cq:
+			msg.Free()
+			return false
+		}
+	}
+
+	return c.overflow(q, msg)
+}
+
+// overflow enqueues msg without blocking, applying the (non-Block) Overflow
+// policy if q is full
+func (c Cfg) overflow(q chan *Message, msg *Message) bool {
+	for {
+		select {
+		case q <- msg:
+			return true
+		default:
+		}
+
+		switch c.Overflow {
+		case DropOldest:
+			select {
+			case old := <-q:
+				old.Free()
+			default: // a consumer emptied the queue in the meantime
+			}
+			continue
+		case Callback:
+			if c.OnDrop != nil {
+				c.OnDrop(msg)
+			}
+		}
+
+		msg.Free()
+		return false
+	}
+}
+
 // MakePortal is for protocol implementations
 func MakePortal(cfg Cfg, p Protocol) Portal {
 	var cancel func()
-	var d ctx.Doner
-	if cfg.Doner == nil {
+	var d = cfg.Doner
+	if d == nil {
 		d = sigctx.New()
 	}
 
@@ -33,10 +120,11 @@ type portal struct {
 
 	id    ID
 	proto Protocol
-	ready bool
+	ready atomic.Bool
 
 	chSend chan *Message
 	chRecv chan *Message
+	chIn   chan *Message // peers deliver here; same as chRecv unless intercepted
 
 	ProtocolSendHook
 	ProtocolRecvHook
@@ -59,97 +147,331 @@ func newPortal(p Protocol, cfg Cfg, cancel func()) *portal {
 		ptl.ProtocolRecvHook = i.(ProtocolRecvHook)
 	}
 
-	p.Init(ptl)
+	if i, ok := interface{}(p).(ProtocolIntake); ok {
+		ptl.chIn = make(chan *Message, cfg.Size)
+		p.Init(intakePortal{ptl})
+		i.Intake(ptl.chIn)
+	} else {
+		ptl.chIn = ptl.chRecv
+		p.Init(ptl)
+	}
 
 	return ptl
 }
 
+// intakePortal is the ProtocolPortal handed to protocols that implement
+// ProtocolIntake.  Peers deliver messages to the intake queue (through
+// portal.RecvChannel), whereas the protocol delivers messages to the
+// application's receive queue.
+type intakePortal struct{ *portal }
+
+func (p intakePortal) RecvChannel() chan<- *Message { return p.chRecv }
+
 func (p *portal) setRunning() {
-	p.ready = true
-	ctx.Defer(p, func() { p.ready = false })
+	p.ready.Store(true)
+	ctx.Defer(p, func() { p.ready.Store(false) })
 }
 
-func (p *portal) Connect(addr string) (err error) {
-	if boundEP, err := addrTable.Lookup(addr); err != nil {
-		err = errors.Wrap(err, addr)
-	} else {
-		boundEP.ConnectEndpoint(p)
-		p.ConnectEndpoint(boundEP)
-		p.setRunning()
+func (p *portal) Connect(addr string) error {
+	boundEP, err := addrTable.Lookup(addr)
+	if err != nil {
+		return errors.Wrap(err, addr)
 	}
 
-	return
+	boundEP.ConnectEndpoint(p)
+	p.ConnectEndpoint(boundEP)
+	p.setRunning()
+
+	return nil
 }
 
-func (p *portal) Bind(addr string) (err error) {
+func (p *portal) Bind(addr string) error {
 	if err := addrTable.Assign(addr, p); err != nil {
-		err = errors.Wrap(err, addr)
-	} else {
-		p.setRunning()
+		return errors.Wrap(err, addr)
 	}
 
-	return
+	p.setRunning()
+	return nil
+}
+
+// connected returns ErrClosed if the portal was closed, or ErrNotConnected if
+// it was never bound or connected.
+func (p *portal) connected() error {
+	select {
+	case <-p.Done():
+		return ErrClosed
+	default:
+	}
+
+	if !p.ready.Load() {
+		return ErrNotConnected
+	}
+
+	return nil
 }
 
 func (p *portal) Send(v interface{}) {
-	if !p.ready {
-		panic(errors.New("send to disconnected portal"))
+	if err := p.connected(); err != nil {
+		panic(err)
+	}
+
+	msg := NewMsg()
+	msg.Value = v
+	_ = p.send(context.Background(), msg)
+}
+
+// SendErr is like Send, but returns an error instead of panicking.  See
+// SendCtx.
+func (p *portal) SendErr(v interface{}) error { return p.SendCtx(context.Background(), v) }
+
+// SendCtx is like Send, but returns early if the context expires before the
+// message is delivered.  The returned error is ctx.Err() if the context was
+// cancelled or its deadline exceeded, ErrClosed if the portal was closed, and
+// ErrNotConnected if the portal was neither bound nor connected.
+func (p *portal) SendCtx(c context.Context, v interface{}) error {
+	if err := p.connected(); err != nil {
+		return err
 	}
 
 	msg := NewMsg()
 	msg.Value = v
+	return p.send(c, msg)
+}
+
+// SendEnvelope is like SendCtx, but additionally sends the envelope's
+// metadata.  The envelope's ID, From and timestamps are assigned by the portal.
+func (p *portal) SendEnvelope(c context.Context, env Envelope) error {
+	if err := p.connected(); err != nil {
+		return err
+	}
 
-	p.SendMsg(msg)
+	msg := NewMsg()
+	msg.Value = env.Value
+	msg.Header = copyHeader(env.Header)
+	msg.ReplyTo = env.ReplyTo
+	if env.To != nil {
+		to := *env.To
+		msg.To = &to
+	}
+
+	return p.send(c, msg)
+}
 
-	if p.Async() {
+func (p *portal) send(c context.Context, msg *Message) (err error) {
+	if err = p.sendMsg(c, msg); err != nil || p.Async() {
 		go msg.wait()
-	} else {
+		return
+	}
+
+	if c.Done() == nil { // context can never expire; avoid the extra goroutine
+		msg.wait()
+		return
+	}
+
+	delivered := make(chan struct{})
+	go func() {
 		msg.wait()
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+	case <-c.Done():
+		err = c.Err()
+	case <-p.Done():
+		err = ErrClosed
+	}
+
+	return
+}
+
+// TrySend enqueues a value without blocking.  It returns false if the send
+// queue is full (or, for synchronous portals, if the protocol is not ready to
+// accept a message), or if the portal is closed or not connected.
+func (p *portal) TrySend(v interface{}) bool {
+	if p.connected() != nil {
+		return false
+	}
+
+	msg := NewMsg()
+	msg.Value = v
+	msg.From = &p.id
+	msg.Sent = time.Now()
+	defer func() { go msg.wait() }()
+
+	if (p.ProtocolSendHook != nil) && !p.SendHook(msg) {
+		msg.Free()
+		return true // drop msg silently
+	}
+
+	select {
+	case p.chSend <- msg:
+		return true
+	default:
+		msg.Free()
+		return false
 	}
 }
 
 func (p *portal) Recv() (v interface{}) {
-	if !p.ready {
-		panic(errors.New("recv from disconnected portal"))
+	var err error
+	if v, err = p.RecvErr(); err == ErrNotConnected {
+		panic(err)
+	}
+
+	return
+}
+
+// RecvErr is like Recv, but returns an error instead of panicking.  This
+// allows callers to distinguish a closed portal from a nil value.  See
+// RecvCtx.
+func (p *portal) RecvErr() (interface{}, error) { return p.RecvCtx(context.Background()) }
+
+// RecvCtx is like Recv, but returns early if the context expires before a
+// value is received.  The returned error is ctx.Err() if the context was
+// cancelled or its deadline exceeded, ErrClosed if the portal was closed, and
+// ErrNotConnected if the portal was neither bound nor connected.
+func (p *portal) RecvCtx(c context.Context) (v interface{}, err error) {
+	if err = p.connected(); err != nil {
+		return
+	}
+
+	var msg *Message
+	if msg, err = p.recvMsg(c); msg != nil {
+		v = msg.Value
+		msg.Free()
+	}
+
+	return
+}
+
+// RecvEnvelope is like RecvCtx, but additionally returns the message's
+// metadata.
+func (p *portal) RecvEnvelope(c context.Context) (env Envelope, err error) {
+	if err = p.connected(); err != nil {
+		return
+	}
+
+	var msg *Message
+	if msg, err = p.recvMsg(c); msg != nil {
+		env = NewEnvelope(msg)
+		msg.Free()
 	}
 
-	if msg := p.RecvMsg(); msg != nil {
+	return
+}
+
+// TryRecv receives a value without blocking.  It returns false if no value is
+// available, or if the portal is closed or not connected.
+func (p *portal) TryRecv() (v interface{}, ok bool) {
+	var msg *Message
+	if msg, ok = p.tryRecvMsg(); ok {
 		v = msg.Value
 		msg.Free()
 	}
+	return
+}
 
+// TryRecvEnvelope is like TryRecv, but additionally returns the message's
+// metadata.
+func (p *portal) TryRecvEnvelope() (env Envelope, ok bool) {
+	var msg *Message
+	if msg, ok = p.tryRecvMsg(); ok {
+		env = NewEnvelope(msg)
+		msg.Free()
+	}
 	return
 }
 
-func (p *portal) SendMsg(msg *Message) {
+func (p *portal) tryRecvMsg() (*Message, bool) {
+	if p.connected() != nil {
+		return nil, false
+	}
+
+	for {
+		var msg *Message
+		select {
+		case msg = <-p.chRecv:
+		default:
+			return nil, false
+		}
+
+		if msg == nil {
+			return nil, false
+		} else if (p.ProtocolRecvHook != nil) && !p.RecvHook(msg) {
+			msg.Free()
+		} else {
+			return msg, true
+		}
+	}
+}
+
+// Len returns the number of messages waiting in the send and receive queues
+func (p *portal) Len() (send, recv int) { return len(p.chSend), len(p.chRecv) }
+
+// Cap returns the capacity of the send and receive queues
+func (p *portal) Cap() (send, recv int) { return cap(p.chSend), cap(p.chRecv) }
+
+func (p *portal) SendMsg(msg *Message) { _ = p.sendMsg(context.Background(), msg) }
+
+func (p *portal) sendMsg(c context.Context, msg *Message) error {
+	if msg.From == nil {
+		msg.From = &p.id
+	}
+	msg.Sent = time.Now()
+
 	if (p.ProtocolSendHook != nil) && !p.SendHook(msg) {
 		msg.Free()
-		return // drop msg silently
+		return nil // drop msg silently
+	}
+
+	if p.Overflow != Block && p.Async() {
+		p.overflow(p.chSend, msg) // dropping the message is not an error
+		return nil
 	}
 
 	select {
 	case p.chSend <- msg:
+		return nil
+	case <-c.Done():
+		msg.Free()
+		return c.Err()
 	case <-p.Done():
 		msg.Free()
+		return ErrClosed
 	}
 }
 
-func (p *portal) RecvMsg() *Message {
+func (p *portal) RecvMsg() (msg *Message) {
+	msg, _ = p.recvMsg(context.Background())
+	return
+}
+
+func (p *portal) recvMsg(c context.Context) (*Message, error) {
 	for {
 		select {
-		case msg := <-p.chRecv:
-			if (p.ProtocolRecvHook != nil) && !p.SendHook(msg) {
+		case msg, ok := <-p.chRecv:
+			if !ok {
+				return nil, ErrClosed
+			} else if msg == nil {
+				return nil, nil
+			} else if (p.ProtocolRecvHook != nil) && !p.RecvHook(msg) {
 				msg.Free()
 			} else {
-				return msg
+				return msg, nil
 			}
+		case <-c.Done():
+			return nil, c.Err()
 		case <-p.Done():
-			return nil
+			return nil, ErrClosed
 		}
 	}
 }
 
-func (p *portal) Close() { p.cancel() }
+func (p *portal) Close() {
+	p.cancel()
+	addrTable.Release(p)
+}
 
 // Implement Endpoint
 func (p *portal) ID() ID { return p.id }
@@ -159,10 +481,22 @@ func (p *portal) ID() ID { return p.id }
 func (p *portal) Signature() ProtocolSignature { return p.proto }
 
 // Implement ProtocolSocket
+func (p *portal) Config() Cfg                   { return p.Cfg }
 func (p *portal) SendChannel() <-chan *Message  { return p.chSend }
-func (p *portal) RecvChannel() chan<- *Message  { return p.chRecv }
+func (p *portal) RecvChannel() chan<- *Message  { return p.chIn }
 func (p *portal) CloseChannel() <-chan struct{} { return p.Done() }
 
+// PeerRecvChannel returns the channel on which the peer with the given ID
+// delivers messages (see ProtocolPeerIntake)
+func (p *portal) PeerRecvChannel(id ID) chan<- *Message {
+	if i, ok := p.proto.(ProtocolPeerIntake); ok {
+		if ch := i.PeerIntake(id); ch != nil {
+			return ch
+		}
+	}
+	return p.chIn
+}
+
 // gc manages the lifecycle of an endpoint in the background
 func (p *portal) ConnectEndpoint(ep Endpoint) {
 	p.proto.AddEndpoint(ep)
@@ -1,6 +1,7 @@
 package portal
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -337,3 +338,420 @@ func TestSendRecvClose(t *testing.T) {
 	})
 
 }
+
+func TestSendRecvCtx(t *testing.T) {
+	p := mockProtoExt{
+		onSend: func(*Message) bool { return true },
+		onRecv: func(*Message) bool { return true },
+	}
+
+	t.Run("RecvCtx", func(t *testing.T) {
+		ptl, _ := mkSendRecvTestPortal(p, 1)
+		if err := ptl.Bind("/foxtrot"); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+		defer ptl.Close()
+
+		t.Run("Deliver", func(t *testing.T) {
+			m := NewMsg()
+			m.Value = true
+			ptl.chRecv <- m
+
+			if v, err := ptl.RecvCtx(context.Background()); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if !v.(bool) {
+				t.Errorf("unexpected value in message (expected true, got %v)", v)
+			}
+		})
+
+		t.Run("Deadline", func(t *testing.T) {
+			c, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+
+			if _, err := ptl.RecvCtx(c); err != context.DeadlineExceeded {
+				t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+			}
+		})
+
+		t.Run("Cancel", func(t *testing.T) {
+			c, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			if _, err := ptl.RecvCtx(c); err != context.Canceled {
+				t.Errorf("expected %s, got %v", context.Canceled, err)
+			}
+		})
+	})
+
+	t.Run("SendCtx", func(t *testing.T) {
+		ptl, _ := mkSendRecvTestPortal(p, 0)
+		if err := ptl.Bind("/golf"); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+		defer ptl.Close()
+
+		t.Run("Deadline", func(t *testing.T) {
+			c, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+
+			if err := ptl.SendCtx(c, true); err != context.DeadlineExceeded {
+				t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+			}
+		})
+
+		t.Run("Undelivered", func(t *testing.T) {
+			c, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+			defer cancel()
+
+			// dequeue the message without freeing it, i.e.: never deliver it
+			go func() { <-ptl.chSend }()
+
+			if err := ptl.SendCtx(c, true); err != context.DeadlineExceeded {
+				t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+			}
+		})
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		ptl, _ := mkSendRecvTestPortal(p, 0)
+		if err := ptl.Bind("/hotel"); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+
+		var g errgroup.Group
+
+		g.Go(func() (err error) {
+			if err = ptl.SendCtx(context.Background(), true); err == ErrClosed {
+				err = nil
+			}
+			return
+		})
+
+		g.Go(func() (err error) {
+			if _, err = ptl.RecvCtx(context.Background()); err == ErrClosed {
+				err = nil
+			}
+			return
+		})
+
+		time.Sleep(time.Millisecond)
+		ptl.Close()
+
+		if err := g.Wait(); err != nil {
+			t.Errorf("expected %s, got %s", ErrClosed, err)
+		}
+	})
+}
+
+func TestSendRecvErr(t *testing.T) {
+	p := mockProtoExt{
+		onSend: func(*Message) bool { return true },
+		onRecv: func(*Message) bool { return true },
+	}
+
+	t.Run("NotConnected", func(t *testing.T) {
+		ptl, _ := mkSendRecvTestPortal(p, 1)
+		defer ptl.Close()
+
+		if err := ptl.SendErr(true); err != ErrNotConnected {
+			t.Errorf("expected %s, got %v", ErrNotConnected, err)
+		}
+
+		if _, err := ptl.RecvErr(); err != ErrNotConnected {
+			t.Errorf("expected %s, got %v", ErrNotConnected, err)
+		}
+	})
+
+	t.Run("NilValue", func(t *testing.T) {
+		ptl, _ := mkSendRecvTestPortal(p, 1)
+		if err := ptl.Bind("/india"); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+		defer ptl.Close()
+
+		ptl.chRecv <- NewMsg()
+
+		if v, err := ptl.RecvErr(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if v != nil {
+			t.Errorf("expected nil value, got %v", v)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		ptl, _ := mkSendRecvTestPortal(p, 1)
+		if err := ptl.Bind("/juliett"); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+		ptl.Close()
+		<-ptl.Done()
+
+		if err := ptl.SendErr(true); err != ErrClosed {
+			t.Errorf("expected %s, got %v", ErrClosed, err)
+		}
+
+		if _, err := ptl.RecvErr(); err != ErrClosed {
+			t.Errorf("expected %s, got %v", ErrClosed, err)
+		}
+	})
+}
+
+func TestTrySendRecv(t *testing.T) {
+	p := mockProtoExt{
+		onSend: func(*Message) bool { return true },
+		onRecv: func(*Message) bool { return true },
+	}
+
+	ptl, _ := mkSendRecvTestPortal(p, 1)
+	if err := ptl.Bind("/lima"); err != nil {
+		t.Errorf("failed to bind: %s", err)
+	}
+	defer ptl.Close()
+
+	t.Run("TrySend", func(t *testing.T) {
+		if !ptl.TrySend(true) {
+			t.Error("send to empty buffer SHOULD have succeeded")
+		}
+
+		if ptl.TrySend(true) {
+			t.Error("send to full buffer SHOULD NOT have succeeded")
+		}
+
+		if n, _ := ptl.Len(); n != 1 {
+			t.Errorf("expected send queue length of 1, got %d", n)
+		}
+
+		(<-ptl.chSend).Free()
+	})
+
+	t.Run("TryRecv", func(t *testing.T) {
+		if _, ok := ptl.TryRecv(); ok {
+			t.Error("recv from empty buffer SHOULD NOT have succeeded")
+		}
+
+		m := NewMsg()
+		m.Value = true
+		ptl.chRecv <- m
+
+		if _, n := ptl.Len(); n != 1 {
+			t.Errorf("expected recv queue length of 1, got %d", n)
+		}
+
+		if v, ok := ptl.TryRecv(); !ok {
+			t.Error("recv from full buffer SHOULD have succeeded")
+		} else if !v.(bool) {
+			t.Errorf("unexpected value in message (expected true, got %v)", v)
+		}
+	})
+
+	t.Run("TryRecvDropped", func(t *testing.T) {
+		pDrop := mockProtoExt{
+			onSend: func(*Message) bool { return true },
+			onRecv: func(*Message) bool { return false },
+		}
+
+		ptl, _ := mkSendRecvTestPortal(pDrop, 1)
+		if err := ptl.Bind("/lima/drop"); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+		defer ptl.Close()
+
+		m := NewMsg()
+		m.Value = true
+		ptl.chRecv <- m
+
+		// the hook rejects the message, after which the queue is empty
+		if v, ok := ptl.TryRecv(); ok || v != nil {
+			t.Errorf("expected (nil, false), got (%v, %v)", v, ok)
+		}
+	})
+
+	t.Run("Cap", func(t *testing.T) {
+		if s, r := ptl.Cap(); s != 1 || r != 1 {
+			t.Errorf("expected capacity of (1, 1), got (%d, %d)", s, r)
+		}
+	})
+
+	t.Run("NotConnected", func(t *testing.T) {
+		ptl, _ := mkSendRecvTestPortal(p, 1)
+		defer ptl.Close()
+
+		if ptl.TrySend(true) {
+			t.Error("send to disconnected portal SHOULD NOT have succeeded")
+		}
+	})
+}
+
+func TestOverflow(t *testing.T) {
+	mkMsg := func(v interface{}) *Message {
+		msg := NewMsg()
+		msg.Value = v
+		return msg
+	}
+
+	fill := func(cfg Cfg) chan *Message {
+		q := make(chan *Message, 2)
+		for i := 0; i < cap(q); i++ {
+			if !cfg.Enqueue(q, mkMsg(i), nil) {
+				t.Errorf("message %d SHOULD have been enqueued", i)
+			}
+		}
+		return q
+	}
+
+	drain := func(q chan *Message) (vs []interface{}) {
+		for len(q) > 0 {
+			msg := <-q
+			vs = append(vs, msg.Value)
+			msg.Free()
+		}
+		return
+	}
+
+	t.Run("Block", func(t *testing.T) {
+		cfg := Cfg{Overflow: Block}
+		q := fill(cfg)
+
+		cq := make(chan struct{})
+		time.AfterFunc(time.Millisecond, func() { close(cq) })
+
+		if cfg.Enqueue(q, mkMsg(2), cq) {
+			t.Error("message SHOULD NOT have been enqueued")
+		}
+
+		if vs := drain(q); len(vs) != 2 || vs[0] != 0 || vs[1] != 1 {
+			t.Errorf("unexpected queue contents (expected [0 1], got %v)", vs)
+		}
+	})
+
+	t.Run("DropNewest", func(t *testing.T) {
+		cfg := Cfg{Overflow: DropNewest}
+		q := fill(cfg)
+
+		if cfg.Enqueue(q, mkMsg(2), nil) {
+			t.Error("message SHOULD NOT have been enqueued")
+		}
+
+		if vs := drain(q); len(vs) != 2 || vs[0] != 0 || vs[1] != 1 {
+			t.Errorf("unexpected queue contents (expected [0 1], got %v)", vs)
+		}
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		cfg := Cfg{Overflow: DropOldest}
+		q := fill(cfg)
+
+		if !cfg.Enqueue(q, mkMsg(2), nil) {
+			t.Error("message SHOULD have been enqueued")
+		}
+
+		if vs := drain(q); len(vs) != 2 || vs[0] != 1 || vs[1] != 2 {
+			t.Errorf("unexpected queue contents (expected [1 2], got %v)", vs)
+		}
+	})
+
+	t.Run("Callback", func(t *testing.T) {
+		var dropped interface{}
+		cfg := Cfg{Overflow: Callback, OnDrop: func(m *Message) { dropped = m.Value }}
+		q := fill(cfg)
+
+		if cfg.Enqueue(q, mkMsg(2), nil) {
+			t.Error("message SHOULD NOT have been enqueued")
+		}
+
+		if dropped != 2 {
+			t.Errorf("expected OnDrop to be called with 2, got %v", dropped)
+		}
+
+		drain(q)
+	})
+
+	t.Run("Portal", func(t *testing.T) {
+		d, cancel := ctx.WithCancel(ctx.Lift(make(chan struct{})))
+		defer cancel()
+
+		ptl := newPortal(mockProto{}, Cfg{Doner: d, Size: 1, Overflow: DropOldest}, cancel)
+		if err := ptl.Bind("/mike"); err != nil {
+			t.Errorf("failed to bind: %s", err)
+		}
+
+		ptl.Send(0)
+		ptl.Send(1) // MUST NOT block
+
+		if vs := drain(ptl.chSend); len(vs) != 1 || vs[0] != 1 {
+			t.Errorf("unexpected queue contents (expected [1], got %v)", vs)
+		}
+	})
+}
+
+func TestEnvelope(t *testing.T) {
+	p := mockProtoExt{
+		onSend: func(*Message) bool { return true },
+		onRecv: func(*Message) bool { return true },
+	}
+
+	ptl, _ := mkSendRecvTestPortal(p, 1)
+	if err := ptl.Bind("/november"); err != nil {
+		t.Errorf("failed to bind: %s", err)
+	}
+	defer ptl.Close()
+
+	t.Run("SendEnvelope", func(t *testing.T) {
+		hdr := map[string]string{"tenant": "acme"}
+		if err := ptl.SendEnvelope(context.Background(), Envelope{Header: hdr, Value: true}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		hdr["tenant"] = "modified after send"
+
+		msg := <-ptl.chSend
+		defer msg.Free()
+
+		if msg.ID == 0 {
+			t.Error("message ID not assigned")
+		}
+
+		if msg.From == nil || *msg.From != ptl.ID() {
+			t.Errorf("unexpected sender (expected %s, got %v)", ptl.ID(), msg.From)
+		}
+
+		if msg.Sent.IsZero() {
+			t.Error("enqueue timestamp not assigned")
+		}
+
+		if msg.Header["tenant"] != "acme" {
+			t.Errorf("unexpected header (expected acme, got %s)", msg.Header["tenant"])
+		}
+	})
+
+	t.Run("RecvEnvelope", func(t *testing.T) {
+		from := NewID()
+
+		m := NewMsg()
+		m.From = &from
+		m.Header = map[string]string{"tenant": "acme"}
+		m.Sent = time.Now()
+		m.Value = true
+		ptl.chRecv <- m
+
+		env, err := ptl.RecvEnvelope(context.Background())
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		if env.From != from {
+			t.Errorf("unexpected sender (expected %s, got %s)", from, env.From)
+		}
+
+		if env.Header["tenant"] != "acme" {
+			t.Errorf("unexpected header (expected acme, got %s)", env.Header["tenant"])
+		}
+
+		if env.Received.Before(env.Sent) {
+			t.Errorf("dequeue timestamp %s precedes enqueue timestamp %s", env.Received, env.Sent)
+		}
+
+		if !env.Value.(bool) {
+			t.Errorf("unexpected value in message (expected true, got %v)", env.Value)
+		}
+	})
+}
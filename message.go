@@ -2,12 +2,16 @@ package portal
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	msgPool = messagePool{
 		Pool: sync.Pool{New: func() interface{} { return new(Message).Ref() }},
 	}
+
+	msgSeq uint64 // source of message IDs
 )
 
 type messagePool struct{ sync.Pool }
@@ -16,13 +20,39 @@ func (pool *messagePool) Get() *Message    { return pool.Pool.Get().(*Message) }
 func (pool *messagePool) Put(msg *Message) { go pool.put(msg) }
 func (pool *messagePool) put(msg *Message) {
 	msg.From = nil
+	msg.To = nil
+	msg.Header = nil
+	msg.ReplyTo = 0
+	msg.Sent = time.Time{}
+	msg.Value = nil
 	pool.Pool.Put(msg)
 }
 
 // Message wraps a value and sends it down the portal
 type Message struct {
-	wg    sync.WaitGroup
-	From  *ID
+	wg sync.WaitGroup
+
+	// ID uniquely identifies the message within the process
+	ID uint64
+
+	// From is the ID of the portal that sent the message
+	From *ID
+
+	// To, if non-nil, addresses the message to a single peer.  Protocols that
+	// do not support addressing ignore it.
+	To *ID
+
+	// Header holds application-defined metadata, e.g. correlation IDs.  It
+	// MUST NOT be modified once the message has been sent.
+	Header map[string]string
+
+	// ReplyTo is the ID of the message this one answers.  It is set by
+	// request/reply style protocols to correlate replies with requests.
+	ReplyTo uint64
+
+	// Sent is the time at which the message was enqueued
+	Sent time.Time
+
 	Value interface{}
 }
 
@@ -45,4 +75,69 @@ func (m *Message) wait() {
 }
 
 // NewMsg returns a message with a single refcount
-func NewMsg() *Message { return msgPool.Get() }
+func NewMsg() *Message {
+	msg := msgPool.Get()
+	msg.ID = atomic.AddUint64(&msgSeq, 1)
+	return msg
+}
+
+// Envelope exposes a message and its metadata to applications.  Unlike a
+// Message, it is a plain value that can be retained and modified freely.
+type Envelope struct {
+	// ID uniquely identifies the message within the process.  It is assigned
+	// by the portal and ignored by SendEnvelope.
+	ID uint64
+
+	// From is the ID of the portal that sent the message.  It is assigned by
+	// the portal and ignored by SendEnvelope.
+	From ID
+
+	// To, if non-nil, addresses the message to a single peer, e.g. in order to
+	// reply to a message received on a BUS.
+	To *ID
+
+	// Header holds application-defined metadata
+	Header map[string]string
+
+	// ReplyTo is the ID of the message this one answers, if any
+	ReplyTo uint64
+
+	// Sent is the time at which the message was enqueued by the sender, and
+	// Received the time at which it was dequeued by the receiver.  They are
+	// assigned by the portal and ignored by SendEnvelope.
+	Sent, Received time.Time
+
+	Value interface{}
+}
+
+// NewEnvelope returns the envelope of a received message, as returned by
+// RecvEnvelope.  The envelope does not share the message's header, so the
+// message may be freed once the envelope has been created.
+func NewEnvelope(msg *Message) (env Envelope) {
+	env.ID = msg.ID
+	if msg.From != nil {
+		env.From = *msg.From
+	}
+	if msg.To != nil {
+		to := *msg.To
+		env.To = &to
+	}
+	env.Header = copyHeader(msg.Header)
+	env.ReplyTo = msg.ReplyTo
+	env.Sent = msg.Sent
+	env.Received = time.Now()
+	env.Value = msg.Value
+	return
+}
+
+func copyHeader(h map[string]string) map[string]string {
+	if h == nil {
+		return nil
+	}
+
+	cp := make(map[string]string, len(h))
+	for k, v := range h {
+		cp[k] = v
+	}
+	return cp
+}
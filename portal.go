@@ -1,6 +1,8 @@
 package portal
 
 import (
+	"context"
+
 	"github.com/SentimensRG/ctx"
 	uuid "github.com/satori/go.uuid"
 )
@@ -20,16 +22,38 @@ type Transporter interface {
 	Close()
 }
 
+// Buffer reports the depth of a portal's send and receive queues
+type Buffer interface {
+	// Len returns the number of messages waiting in the send and receive queues
+	Len() (send, recv int)
+
+	// Cap returns the capacity of the send and receive queues
+	Cap() (send, recv int)
+}
+
 // ReadOnly is the portal equivalent of <-chan
 type ReadOnly interface {
 	Transporter
+	Buffer
+	ID() ID
 	Recv() interface{}
+	TryRecv() (interface{}, bool)
+	RecvErr() (interface{}, error)
+	RecvCtx(context.Context) (interface{}, error)
+	RecvEnvelope(context.Context) (Envelope, error)
+	TryRecvEnvelope() (Envelope, bool)
 }
 
 // WriteOnly is the portal equivalent of chan<-
 type WriteOnly interface {
 	Transporter
+	Buffer
+	ID() ID
 	Send(interface{})
+	TrySend(interface{}) bool
+	SendErr(interface{}) error
+	SendCtx(context.Context, interface{}) error
+	SendEnvelope(context.Context, Envelope) error
 }
 
 // Portal is the main access handle applications use to access the protocol
@@ -38,8 +62,39 @@ type WriteOnly interface {
 // at a time.
 type Portal interface {
 	Transporter
+	Buffer
+
+	// ID uniquely identifies the portal.  It is reported as the sender of each
+	// message it sends (see Envelope).
+	ID() ID
+
 	Send(interface{})
 	Recv() interface{}
+
+	// TrySend and TryRecv are non-blocking variants of Send and Recv.  They
+	// return false if the operation would block, or if the portal is closed or
+	// not connected.
+	TrySend(interface{}) bool
+	TryRecv() (interface{}, bool)
+
+	// SendErr and RecvErr are like Send and Recv, but return ErrClosed or
+	// ErrNotConnected instead of panicking or returning a nil value.
+	SendErr(interface{}) error
+	RecvErr() (interface{}, error)
+
+	// SendCtx and RecvCtx are context-aware variants of SendErr and RecvErr.
+	// They additionally return ctx.Err() if the context expires before the
+	// operation completes.
+	SendCtx(context.Context, interface{}) error
+	RecvCtx(context.Context) (interface{}, error)
+
+	// SendEnvelope and RecvEnvelope are like SendCtx and RecvCtx, but expose
+	// message metadata such as the sender's ID, headers and timestamps.
+	SendEnvelope(context.Context, Envelope) error
+	RecvEnvelope(context.Context) (Envelope, error)
+
+	// TryRecvEnvelope is the non-blocking variant of RecvEnvelope
+	TryRecvEnvelope() (Envelope, bool)
 }
 
 // Endpoint is used by the Protocol implementation to access the underlying
@@ -108,6 +163,14 @@ type ProtocolPortal interface {
 	// later.
 	RecvChannel() chan<- *Message
 
+	// ID of the portal
+	ID() ID
+
+	// Config returns the portal's configuration.  Protocols that maintain
+	// their own queues should size them according to Cfg.Size and fill them
+	// using Cfg.Enqueue, so that the Overflow policy is applied consistently.
+	Config() Cfg
+
 	// The protocol can wait on this channel to close.  When it is closed,
 	// it indicates that the application has closed the upper read socket,
 	// and the protocol should stop any further read operations on this
@@ -124,6 +187,25 @@ type ProtocolSendHook interface {
 	SendHook(*Message) bool
 }
 
+// ProtocolIntake allows protocols to process messages sent by peers before they
+// are queued for the application, e.g. to discard stale replies.
+type ProtocolIntake interface {
+	// Intake is called once by the core, immediately after Init, with the
+	// channel on which peers deliver messages to the portal.  The protocol is
+	// responsible for forwarding messages to ProtocolPortal.RecvChannel (or
+	// freeing them), and should stop reading when the portal is closed.
+	Intake(<-chan *Message)
+}
+
+// ProtocolPeerIntake allows protocols that implement ProtocolIntake to queue
+// the messages of each peer separately, so that a peer whose queue is full
+// does not hold up the others.
+type ProtocolPeerIntake interface {
+	// PeerIntake returns the channel on which the peer with the given ID
+	// delivers messages, or nil if it delivers them to the intake queue.
+	PeerIntake(ID) chan<- *Message
+}
+
 // ProtocolRecvHook allows protocol implementers to extend existing protocols
 type ProtocolRecvHook interface {
 	// RecvHook is called just before the message is handed to the
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownPeer is returned when sending to a DEALER that is not connected
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// Protocol implementing BROKER
+type Protocol struct {
+	ptl portal.ProtocolPortal
+	n   proto.Neighborhood
+}
+
+// Init the protocol (called by portal)
+func (p *Protocol) Init(ptl portal.ProtocolPortal) {
+	p.ptl = ptl
+	p.n = proto.NewNeighborhood()
+	go p.startSending()
+}
+
+// SendHook drops messages that are not addressed to a connected DEALER
+func (p *Protocol) SendHook(msg *portal.Message) bool {
+	if msg.To == nil {
+		return false
+	}
+
+	_, ok := p.n.GetPeer(*msg.To)
+	return ok
+}
+
+func (p *Protocol) startSending() {
+	sq := p.ptl.SendChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-sq:
+			if peer, ok := p.n.GetPeer(*msg.To); ok {
+				proto.Deliver(peer, msg, cq)
+			} else {
+				msg.Free() // dealer went away
+			}
+		}
+	}
+}
+
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
+	proto.MustBeCompatible(p, ep.Signature())
+	p.n.SetPeer(ep.ID(), ep)
+}
+
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
+
+func (*Protocol) Number() uint16     { return proto.Brok }
+func (*Protocol) PeerNumber() uint16 { return proto.Deal }
+func (*Protocol) Name() string       { return "broker" }
+func (*Protocol) PeerName() string   { return "dealer" }
+
+// Portal is a BROKER portal.  Values received from DEALER portals are tagged
+// with the ID of the originating DEALER, and values are sent to a specific
+// DEALER by ID.  Values sent without a destination (e.g. using Send) are
+// dropped.
+type Portal interface {
+	portal.Portal
+
+	// SendTo sends a value to the DEALER with the specified ID.  It returns
+	// ErrUnknownPeer if no such DEALER is connected.
+	SendTo(portal.ID, interface{}) error
+
+	// RecvFrom receives a value along with the ID of the DEALER that sent it
+	RecvFrom() (portal.ID, interface{}, error)
+}
+
+type broker struct {
+	portal.Portal
+	proto *Protocol
+}
+
+func (b broker) SendTo(id portal.ID, v interface{}) error {
+	if _, ok := b.proto.n.GetPeer(id); !ok {
+		return ErrUnknownPeer
+	}
+
+	return b.SendEnvelope(context.Background(), portal.Envelope{To: &id, Value: v})
+}
+
+func (b broker) RecvFrom() (portal.ID, interface{}, error) {
+	env, err := b.RecvEnvelope(context.Background())
+	return env.From, env.Value, err
+}
+
+// New allocates a portal using the BROKER protocol
+func New(cfg portal.Cfg) Portal {
+	p := &Protocol{}
+	return broker{Portal: portal.MakePortal(cfg, p), proto: p}
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/dealer"
+)
+
+func TestIntegration(t *testing.T) {
+	const nDeal = 3
+
+	b := New(portal.Cfg{})
+	if err := b.Bind("/test/broker/integration"); err != nil {
+		t.Error(err)
+	}
+
+	deals := make([]portal.Portal, nDeal)
+	for i := range deals {
+		deals[i] = dealer.New(portal.Cfg{})
+		if err := deals[i].Connect("/test/broker/integration"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Run("RecvFrom", func(t *testing.T) {
+		for i, d := range deals {
+			go d.Send(i)
+		}
+
+		for i := 0; i < nDeal; i++ {
+			id, v, err := b.RecvFrom()
+			if err != nil {
+				t.Error(err)
+			} else if deals[v.(int)].ID() != id {
+				t.Errorf("value %v tagged with wrong peer %s", v, id)
+			}
+		}
+	})
+
+	t.Run("SendTo", func(t *testing.T) {
+		ch := make(chan portal.ID, nDeal)
+		for _, d := range deals {
+			go func(d portal.Portal) {
+				if d.Recv() != nil {
+					ch <- d.ID()
+				}
+			}(d)
+		}
+
+		if err := b.SendTo(deals[1].ID(), true); err != nil {
+			t.Error(err)
+		}
+
+		select {
+		case id := <-ch:
+			if id != deals[1].ID() {
+				t.Errorf("value delivered to %s instead of %s", id, deals[1].ID())
+			}
+		case <-time.After(time.Millisecond * 10):
+			t.Error("dealer did not recv value")
+		}
+
+		select {
+		case id := <-ch:
+			t.Errorf("value erroneously delivered to %s", id)
+		case <-time.After(time.Millisecond * 10):
+		}
+	})
+
+	t.Run("UnknownPeer", func(t *testing.T) {
+		if err := b.SendTo(portal.NewID(), true); err != ErrUnknownPeer {
+			t.Errorf("expected %s, got %v", ErrUnknownPeer, err)
+		}
+	})
+}
+
+func TestLoadBalancing(t *testing.T) {
+	const nBrok, iter = 2, 10
+
+	d := dealer.New(portal.Cfg{})
+	if err := d.Bind("/test/broker/loadbalancing"); err != nil {
+		t.Error(err)
+	}
+
+	counts := make(chan int, nBrok)
+	for i := 0; i < nBrok; i++ {
+		b := New(portal.Cfg{})
+		if err := b.Connect("/test/broker/loadbalancing"); err != nil {
+			t.Error(err)
+		}
+
+		go func(b Portal) {
+			var n int
+			for i := 0; i < iter/nBrok; i++ {
+				if _, _, err := b.RecvFrom(); err == nil {
+					n++
+				}
+			}
+			counts <- n
+		}(b)
+	}
+
+	for i := 0; i < iter; i++ {
+		d.Send(i)
+	}
+
+	for i := 0; i < nBrok; i++ {
+		select {
+		case n := <-counts:
+			if n != iter/nBrok {
+				t.Errorf("expected %d values per broker, got %d", iter/nBrok, n)
+			}
+		case <-time.After(time.Millisecond * 100):
+			t.Error("values were not load-balanced across brokers")
+		}
+	}
+}
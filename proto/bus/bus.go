@@ -1,9 +1,6 @@
 package bus
 
 import (
-	"sync"
-
-	"github.com/SentimensRG/ctx"
 	"github.com/lthibault/portal"
 	proto "github.com/lthibault/portal/proto"
 )
@@ -20,11 +17,7 @@ func (b busEP) close() {
 }
 
 func (b busEP) sendMsg(msg *portal.Message) {
-	select {
-	case b.q <- msg:
-	case <-b.Done():
-		msg.Free()
-	}
+	b.bus.ptl.Config().Enqueue(b.q, msg, b.Done())
 }
 
 func (b busEP) startSending() {
@@ -40,23 +33,6 @@ func (b busEP) startSending() {
 	}
 }
 
-func (b busEP) startReceiving() {
-	rq := b.bus.ptl.RecvChannel()
-	cq := ctx.Link(ctx.Lift(b.bus.ptl.CloseChannel()), b)
-
-	for msg := range b.SendChannel() {
-		id := b.ID()
-		msg.From = &id
-
-		select {
-		case <-cq:
-			msg.Free()
-			return
-		case rq <- msg:
-		}
-	}
-}
-
 // Protocol implementing BUS
 type Protocol struct {
 	ptl portal.ProtocolPortal
@@ -71,8 +47,6 @@ func (p *Protocol) Init(ptl portal.ProtocolPortal) {
 }
 
 func (p Protocol) startSending() {
-	var wg sync.WaitGroup
-
 	sq := p.ptl.SendChannel()
 	cq := p.ptl.CloseChannel()
 
@@ -88,20 +62,23 @@ func (p Protocol) startSending() {
 				panic("ensure portal.Doner fires closes before chSend/chRecv")
 			}
 
-			// broadcast
+			// broadcast, unless the message is addressed to a specific peer
 			m, done := p.n.RMap() // get a read-locked map-view of the Neighborhood
 			for id, peer := range m {
-				// if there's a header, it means the msg was rebroadcast
+				// never echo a message back to its sender
 				if msg.From != nil && id == *msg.From {
 					continue
 				}
 
+				if msg.To != nil && id != *msg.To {
+					continue
+				}
+
 				// proto.Neighborhood stores portal.Endpoints, so we must type-assert
-				wg.Add(1)
 				peer.(*busEP).sendMsg(msg.Ref())
 			}
 			done()
-			wg.Done()
+			msg.Free()
 		}
 	}
 }
@@ -109,10 +86,9 @@ func (p Protocol) startSending() {
 func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
 	proto.MustBeCompatible(p, ep.Signature())
 
-	pe := &busEP{Endpoint: ep, q: make(chan *portal.Message, 1), bus: p}
+	pe := &busEP{Endpoint: ep, q: make(chan *portal.Message, proto.QueueSize(p.ptl)), bus: p}
 	p.n.SetPeer(ep.ID(), pe)
 	go pe.startSending()
-	go pe.startReceiving()
 }
 
 func (p Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
@@ -126,3 +102,6 @@ func (Protocol) PeerName() string   { return "bus" }
 func New(cfg portal.Cfg) portal.Portal {
 	return portal.MakePortal(cfg, &Protocol{})
 }
+
+// NewOf allocates a type-safe portal using the BUS protocol
+func NewOf[T any](cfg portal.Cfg) portal.Typed[T] { return portal.Typed[T]{Portal: New(cfg)} }
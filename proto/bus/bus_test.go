@@ -1,6 +1,7 @@
 package bus
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
@@ -35,8 +36,8 @@ func TestIntegration(t *testing.T) {
 
 		ch := make(chan struct{})
 		chSync := make(chan struct{})
+		wg.Add(nPtls - 1)
 		go func() {
-			wg.Add(nPtls - 1)
 			close(chSync)
 			wg.Wait()
 			ch <- struct{}{}
@@ -100,3 +101,58 @@ func TestIntegration(t *testing.T) {
 		}
 	})
 }
+
+func TestReply(t *testing.T) {
+	const nPtls = 4
+
+	ptls := make([]portal.Portal, nPtls)
+	for i := range ptls {
+		ptls[i] = New(portal.Cfg{})
+	}
+
+	bP, cP := ptls[0], ptls[1:]
+
+	if err := bP.Bind("/test/bus/reply"); err != nil {
+		t.Error(err)
+	}
+
+	for i, p := range cP {
+		if err := p.Connect("/test/bus/reply"); err != nil {
+			t.Errorf("portal %d: %s", i, err)
+		}
+	}
+
+	go cP[0].Send(true)
+
+	env, err := bP.RecvEnvelope(context.Background())
+	if err != nil {
+		t.Error(err)
+	} else if env.From != cP[0].ID() {
+		t.Errorf("unexpected sender (expected %s, got %s)", cP[0].ID(), env.From)
+	}
+
+	go bP.SendEnvelope(context.Background(), portal.Envelope{To: &env.From, Value: true})
+
+	ch := make(chan portal.ID, len(cP))
+	for _, p := range cP {
+		go func(p portal.Portal) {
+			_ = p.Recv().(bool)
+			ch <- p.ID()
+		}(p)
+	}
+
+	select {
+	case id := <-ch:
+		if id != env.From {
+			t.Errorf("reply delivered to %s instead of %s", id, env.From)
+		}
+	case <-time.After(time.Millisecond * 10):
+		t.Error("sender did not recv reply")
+	}
+
+	select {
+	case id := <-ch:
+		t.Errorf("reply erroneously delivered to %s", id)
+	case <-time.After(time.Millisecond * 10):
+	}
+}
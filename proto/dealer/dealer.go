@@ -0,0 +1,89 @@
+package dealer
+
+import (
+	"sync"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+)
+
+// Protocol implementing DEALER
+type Protocol struct {
+	ptl portal.ProtocolPortal
+
+	sync.Mutex
+	peers []portal.Endpoint
+	next  int
+}
+
+// Init the protocol (called by portal)
+func (p *Protocol) Init(ptl portal.ProtocolPortal) {
+	p.ptl = ptl
+	go p.startSending()
+}
+
+// peer returns the next BROKER in round-robin order
+func (p *Protocol) peer() (ep portal.Endpoint, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if ok = len(p.peers) > 0; ok {
+		p.next = (p.next + 1) % len(p.peers)
+		ep = p.peers[p.next]
+	}
+
+	return
+}
+
+func (p *Protocol) startSending() {
+	sq := p.ptl.SendChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-sq:
+			if peer, ok := p.peer(); ok {
+				proto.Deliver(peer, msg, cq)
+			} else {
+				msg.Free() // no broker to send to
+			}
+		}
+	}
+}
+
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
+	proto.MustBeCompatible(p, ep.Signature())
+
+	p.Lock()
+	p.peers = append(p.peers, ep)
+	p.Unlock()
+}
+
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, peer := range p.peers {
+		if peer.ID() == ep.ID() {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			break
+		}
+	}
+}
+
+func (*Protocol) Number() uint16     { return proto.Deal }
+func (*Protocol) PeerNumber() uint16 { return proto.Brok }
+func (*Protocol) Name() string       { return "dealer" }
+func (*Protocol) PeerName() string   { return "broker" }
+
+// New allocates a portal using the DEALER protocol.  Values sent through a
+// DEALER portal are load-balanced across connected BROKER portals in
+// round-robin order.
+func New(cfg portal.Cfg) portal.Portal {
+	return portal.MakePortal(cfg, &Protocol{})
+}
+
+// NewOf allocates a type-safe portal using the DEALER protocol
+func NewOf[T any](cfg portal.Cfg) portal.Typed[T] { return portal.Typed[T]{Portal: New(cfg)} }
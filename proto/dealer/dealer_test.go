@@ -0,0 +1,133 @@
+package dealer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/broker"
+)
+
+// deal sends nMsg values through the DEALER portal, and returns the values
+// received by each BROKER portal.  Each broker is expected to receive
+// nMsg/len(bs) values.
+func deal(t *testing.T, d portal.Portal, bs []broker.Portal, nMsg int) [][]int {
+	ch := make(chan []int, len(bs))
+	for _, b := range bs {
+		go func(b broker.Portal) {
+			vs := make([]int, 0, nMsg/len(bs))
+			for i := 0; i < nMsg/len(bs); i++ {
+				if _, v, err := b.RecvFrom(); err == nil {
+					vs = append(vs, v.(int))
+				}
+			}
+			ch <- vs
+		}(b)
+	}
+
+	go func() {
+		for i := 0; i < nMsg; i++ {
+			d.Send(i)
+		}
+	}()
+
+	recvd := make([][]int, 0, len(bs))
+	for range bs {
+		select {
+		case vs := <-ch:
+			recvd = append(recvd, vs)
+		case <-time.After(time.Millisecond * 100):
+			t.Fatal("values were not distributed across brokers")
+		}
+	}
+	return recvd
+}
+
+// checkRoundRobin fails the test unless each broker received every
+// len(recvd)th value, in order
+func checkRoundRobin(t *testing.T, recvd [][]int) {
+	for i, vs := range recvd {
+		for j := 1; j < len(vs); j++ {
+			if vs[j] != vs[j-1]+len(recvd) {
+				t.Errorf("broker %d: values %v were not dealt in round-robin order", i, vs)
+				break
+			}
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	const nBrok, iter = 3, 4
+
+	p := &Protocol{}
+	d := portal.MakePortal(portal.Cfg{}, p)
+	defer d.Close()
+
+	if err := d.Bind("/test/dealer/roundrobin"); err != nil {
+		t.Error(err)
+	}
+
+	bs := make([]broker.Portal, nBrok)
+	for i := range bs {
+		bs[i] = broker.New(portal.Cfg{})
+		if err := bs[i].Connect("/test/dealer/roundrobin"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Run("Distribution", func(t *testing.T) {
+		checkRoundRobin(t, deal(t, d, bs, nBrok*iter))
+	})
+
+	// Closing a BROKER would close the DEALER too, since the broker drops its
+	// peers when it disconnects, so brokers are removed through the protocol.
+	remove := func(b broker.Portal) {
+		p.Lock()
+		var ep portal.Endpoint
+		for _, peer := range p.peers {
+			if peer.ID() == b.ID() {
+				ep = peer
+			}
+		}
+		p.Unlock()
+
+		if ep == nil {
+			t.Fatalf("broker %s is not connected", b.ID())
+		}
+		p.RemoveEndpoint(ep)
+	}
+
+	t.Run("RemoveEndpoint", func(t *testing.T) {
+		remove(bs[0])
+
+		recvd := deal(t, d, bs[1:], (nBrok-1)*iter)
+		for i, vs := range recvd {
+			if len(vs) != iter {
+				t.Errorf("broker %d: expected %d values, got %d", i, iter, len(vs))
+			}
+		}
+		checkRoundRobin(t, recvd)
+
+		if _, n := bs[0].Len(); n != 0 {
+			t.Errorf("%d values delivered to removed broker", n)
+		}
+	})
+
+	t.Run("NoBrokers", func(t *testing.T) {
+		for _, b := range bs[1:] {
+			remove(b)
+		}
+
+		ch := make(chan struct{})
+		go func() {
+			d.Send(true) // dropped, since there is no broker to send to
+			close(ch)
+		}()
+
+		select {
+		case <-ch:
+		case <-time.After(time.Millisecond * 100):
+			t.Error("send blocked with no broker connected")
+		}
+	})
+}
@@ -92,3 +92,6 @@ func (p *Protocol) startSending() {
 func New(cfg portal.Cfg) portal.Portal {
 	return portal.MakePortal(cfg, &Protocol{})
 }
+
+// NewOf allocates a type-safe Portal using the PAIR protocol
+func NewOf[T any](cfg portal.Cfg) portal.Typed[T] { return portal.Typed[T]{Portal: New(cfg)} }
@@ -23,6 +23,94 @@ const (
 	Deal
 )
 
+// Header keys reserved by the request/reply protocols
+const (
+	// HdrStream marks a request to which multiple replies may be sent
+	HdrStream = "portal.stream"
+
+	// HdrEOS marks the final reply to a streaming request.  The reply's value
+	// is the error that terminated the stream, or nil.
+	HdrEOS = "portal.eos"
+
+	// HdrCancel marks a message informing the responder that the request
+	// identified by ReplyTo has been abandoned
+	HdrCancel = "portal.cancel"
+)
+
+// Header keys reserved by the pipeline protocols
+const (
+	// HdrKey holds the routing key of a message, e.g. for PUSH's KeyAffinity
+	// strategy
+	HdrKey = "portal.key"
+
+	// HdrDelivery holds the number of times a message that must be
+	// acknowledged has been delivered, including the current delivery
+	HdrDelivery = "portal.delivery"
+
+	// HdrAck marks a message informing the sender that the message identified
+	// by ReplyTo was processed
+	HdrAck = "portal.ack"
+
+	// HdrNack marks a message informing the sender that the message
+	// identified by ReplyTo was rejected, and should be redelivered
+	HdrNack = "portal.nack"
+)
+
+// Header keys reserved by the publish/subscribe protocols
+const (
+	// HdrTopic holds the topic of a message published on a PUB portal.  It
+	// takes precedence over the topic of a Topical value.
+	HdrTopic = "portal.topic"
+
+	// HdrSubscribe marks a message whose value is the Filter with which a SUB
+	// portal selects the messages it receives
+	HdrSubscribe = "portal.subscribe"
+)
+
+// Filter selects messages.  SUB portals advertise their subscriptions to PUB
+// portals as a Filter, so that messages are only sent to interested
+// subscribers.  A Filter MUST be safe for concurrent use.
+type Filter interface {
+	Match(*portal.Message) bool
+}
+
+// QueueSize returns the capacity of per-peer queues maintained by fan-out
+// protocols.  It is the portal's buffer size, with a minimum of 1.
+func QueueSize(ptl portal.ProtocolPortal) int {
+	if n := ptl.Config().Size; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// PeerRecvChannel returns the channel on which the peer with the given ID
+// delivers messages to an endpoint.  It is the endpoint's RecvChannel, unless
+// the endpoint's protocol queues each peer's messages separately (see
+// portal.ProtocolPeerIntake).
+func PeerRecvChannel(ep portal.Endpoint, id portal.ID) chan<- *portal.Message {
+	if pe, ok := ep.(interface {
+		PeerRecvChannel(portal.ID) chan<- *portal.Message
+	}); ok {
+		return pe.PeerRecvChannel(id)
+	}
+	return ep.RecvChannel()
+}
+
+// Deliver sends msg to the endpoint's receive queue.  It returns false if the
+// endpoint was closed or cq fired before the message could be delivered, in
+// which case msg is freed.
+func Deliver(ep portal.Endpoint, msg *portal.Message, cq <-chan struct{}) bool {
+	select {
+	case ep.RecvChannel() <- msg:
+		return true
+	case <-ep.Done():
+	case <-cq:
+	}
+
+	msg.Free()
+	return false
+}
+
 // EndpointsCompatible returns true if the Endpoints have compatible protocols
 func EndpointsCompatible(sig0, sig1 portal.ProtocolSignature) bool {
 	return sig0.Number() == sig1.PeerNumber() && sig0.Number() == sig1.PeerNumber()
@@ -60,6 +148,7 @@ type Neighborhood interface {
 	SetPeer(portal.ID, portal.Endpoint)
 	GetPeer(portal.ID) (portal.Endpoint, bool)
 	DropPeer(portal.ID)
+	RemovePeer(portal.ID)
 }
 
 // neighborhood stores connected peer endpoints
@@ -91,6 +180,13 @@ func (n *neighborhood) GetPeer(id portal.ID) (p portal.Endpoint, ok bool) {
 	return
 }
 
+// RemovePeer forgets a peer without closing it
+func (n *neighborhood) RemovePeer(id portal.ID) {
+	n.Lock()
+	delete(n.epts, id)
+	n.Unlock()
+}
+
 func (n *neighborhood) DropPeer(id portal.ID) {
 	n.Lock()
 	pe := n.epts[id]
@@ -52,6 +52,14 @@ func TestNeighborhood(t *testing.T) {
 		}
 	})
 
+	t.Run("RemovePeer", func(t *testing.T) {
+		n.SetPeer(u, nil)
+		n.RemovePeer(u)
+		if _, ok := n.epts[u]; ok {
+			t.Error("remove operation did not evict PeerEndpoint from map")
+		}
+	})
+
 	t.Run("RMap", func(t *testing.T) {
 		for i := 0; i < 8; i++ {
 			n.SetPeer(portal.NewID(), nil)
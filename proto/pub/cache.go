@@ -0,0 +1,143 @@
+package pub
+
+import (
+	"sort"
+	"time"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+)
+
+// CachePolicy governs the messages that a PUB portal retains for the SUB
+// portals that connect after they were sent.  Retained messages are delivered
+// to each SUB portal as soon as it connects, in the order in which they were
+// sent, and before any new message.  The zero value disables caching.
+type CachePolicy struct {
+	// LastValue retains the latest message for each key, so that SUB portals
+	// start with the current value of every key
+	LastValue bool
+
+	// Key returns the key under which a message is retained by LastValue.  It
+	// defaults to the message's topic (see proto.HdrTopic and sub.Topical).
+	// Messages without a key are not retained.  Key MUST NOT retain or modify
+	// the message.
+	Key func(*portal.Message) (string, bool)
+
+	// Replay retains the last Replay messages, regardless of their key
+	Replay int
+}
+
+func (cp CachePolicy) key(msg *portal.Message) (string, bool) { return keyOf(cp.Key, msg) }
+
+// keyOf returns the key of a message, which defaults to its topic
+func keyOf(key func(*portal.Message) (string, bool), msg *portal.Message) (string, bool) {
+	if key != nil {
+		return key(msg)
+	}
+
+	if t, ok := msg.Header[proto.HdrTopic]; ok {
+		return t, true
+	}
+
+	if t, ok := msg.Value.(interface{ Topic() string }); ok {
+		return t.Topic(), true
+	}
+
+	return "", false
+}
+
+// entry is a copy of a retained message.  Retaining the message itself would
+// prevent the publisher's call to Send from returning.
+type entry struct {
+	id     uint64
+	from   *portal.ID
+	header map[string]string
+	sent   time.Time
+	value  interface{}
+}
+
+func newEntry(msg *portal.Message) *entry {
+	return &entry{id: msg.ID, from: msg.From, header: msg.Header, sent: msg.Sent, value: msg.Value}
+}
+
+// msg returns a copy of the retained message, for delivery to a SUB portal
+func (e *entry) msg() *portal.Message {
+	msg := portal.NewMsg()
+	msg.ID = e.id
+	msg.From = e.from
+	msg.Header = e.header
+	msg.Sent = e.sent
+	msg.Value = e.value
+	return msg
+}
+
+// cache of retained messages.  It is guarded by the protocol's lock.
+type cache struct {
+	CachePolicy
+	last   map[string]*entry
+	replay []*entry // ring buffer
+	head   int      // oldest entry, once the ring buffer is full
+}
+
+func newCache(cp CachePolicy) cache {
+	return cache{CachePolicy: cp, last: make(map[string]*entry)}
+}
+
+// record a message that is being published
+func (c *cache) record(msg *portal.Message) {
+	if !c.LastValue && c.Replay < 1 {
+		return
+	}
+
+	e := newEntry(msg)
+
+	if c.LastValue {
+		if k, ok := c.key(msg); ok {
+			c.last[k] = e
+		}
+	}
+
+	if c.Replay > 0 {
+		if len(c.replay) < c.Replay {
+			c.replay = append(c.replay, e)
+		} else {
+			c.replay[c.head] = e
+			c.head = (c.head + 1) % c.Replay
+		}
+	}
+}
+
+// snapshot returns copies of the retained messages, in the order in which they
+// were sent.  Messages retained both as a last value and for replay are only
+// returned once.
+func (c *cache) snapshot() []*portal.Message {
+	es := make([]*entry, 0, len(c.last)+len(c.replay))
+	seen := make(map[*entry]bool, len(c.replay))
+
+	for _, e := range c.replay {
+		seen[e] = true
+		es = append(es, e)
+	}
+
+	for _, e := range c.last {
+		if !seen[e] {
+			es = append(es, e)
+		}
+	}
+
+	sort.Slice(es, func(i, j int) bool { return es[i].id < es[j].id })
+
+	msgs := make([]*portal.Message, len(es))
+	for i, e := range es {
+		msgs[i] = e.msg()
+	}
+	return msgs
+}
+
+// SetCachePolicy sets the policy governing the messages retained for SUB
+// portals that connect later.  Previously retained messages are discarded.
+func (p *Protocol) SetCachePolicy(cp CachePolicy) {
+	p.Lock()
+	p.cache = newCache(cp)
+	p.Unlock()
+}
@@ -11,20 +11,51 @@ import (
 type Protocol struct {
 	ptl portal.ProtocolPortal
 	n   proto.Neighborhood
+
+	sync.RWMutex
+	filters  map[portal.ID]proto.Filter // advertised by SUB portals
+	cache    cache
+	queuing  QueuePolicy
+	policies map[portal.ID]QueuePolicy
 }
 
 // Init the Protocol
 func (p *Protocol) Init(ptl portal.ProtocolPortal) {
 	p.ptl = ptl
 	p.n = proto.NewNeighborhood()
+	p.filters = make(map[portal.ID]proto.Filter)
+	p.cache = newCache(CachePolicy{})
+	p.queuing = QueuePolicy{Overflow: ptl.Config().Overflow}
+	p.policies = make(map[portal.ID]QueuePolicy)
 	go p.startSending()
 }
 
-func (p Protocol) startSending() {
+// Intake records the subscriptions advertised by SUB portals
+func (p *Protocol) Intake(in <-chan *portal.Message) { go p.startReceiving(in) }
+
+func (p *Protocol) startReceiving(in <-chan *portal.Message) {
 	cq := p.ptl.CloseChannel()
-	sq := p.ptl.SendChannel()
 
-	var wg sync.WaitGroup
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-in:
+			if f, ok := msg.Value.(proto.Filter); ok && msg.From != nil {
+				if _, ok = msg.Header[proto.HdrSubscribe]; ok {
+					p.Lock()
+					p.filters[*msg.From] = f
+					p.Unlock()
+				}
+			}
+			msg.Free()
+		}
+	}
+}
+
+func (p *Protocol) startSending() {
+	cq := p.ptl.CloseChannel()
+	sq := p.ptl.SendChannel()
 
 	for {
 		select {
@@ -38,36 +69,157 @@ func (p Protocol) startSending() {
 				panic("ensure portal.Doner fires closes before chSend/chRecv")
 			}
 
-			m, done := p.n.RMap()
-			wg.Add(len(m))
+			// A message is either retained before a SUB portal connects, and
+			// delivered as part of its snapshot, or sent to it afterwards.
+			p.Lock()
+			p.cache.record(msg)
+			pes := p.targets(msg)
+			p.Unlock()
 
-			for _, peer := range m {
-				go func(p portal.Endpoint) {
-					p.RecvChannel() <- msg.Ref()
-					wg.Done()
-				}(peer)
+			// Each subscriber has its own queue, so that the queue policy
+			// only affects the subscribers that aren't keeping up.
+			for _, pe := range pes {
+				if !pe.enqueue(msg.Ref()) {
+					p.detach(pe)
+				}
 			}
 
-			done()
-			wg.Wait()
 			msg.Free()
 		}
 	}
 }
 
-func (p Protocol) AddEndpoint(ep portal.Endpoint) {
+// targets returns the subscribers interested in msg.  SUB portals that have
+// not advertised their subscriptions receive every message.  The caller must
+// hold the lock.
+func (p *Protocol) targets(msg *portal.Message) (pes []*pubEP) {
+	m, done := p.n.RMap()
+	defer done()
+
+	for id, peer := range m {
+		if f, ok := p.filters[id]; !ok || f.Match(msg) {
+			pes = append(pes, peer.(*pubEP))
+		}
+	}
+	return
+}
+
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
 	proto.MustBeCompatible(p, ep.Signature())
-	p.n.SetPeer(ep.ID(), ep)
+
+	p.Lock()
+	qp, ok := p.policies[ep.ID()]
+	if !ok {
+		qp = p.queuing
+	}
+	if qp.Size < 1 {
+		qp.Size = proto.QueueSize(p.ptl)
+	}
+
+	pe := newPubEP(ep, qp, p.ptl.Config().OnDrop)
+	pe.snapshot = p.cache.snapshot()
+	p.n.SetPeer(ep.ID(), pe)
+	p.Unlock()
+
+	go pe.startSending()
 }
 
-func (p Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) {
+	p.n.DropPeer(ep.ID())
+
+	p.Lock()
+	delete(p.filters, ep.ID())
+	p.Unlock()
+}
 
-func (Protocol) Number() uint16     { return proto.Pub }
-func (Protocol) PeerNumber() uint16 { return proto.Sub }
-func (Protocol) Name() string       { return "pub" }
-func (Protocol) PeerName() string   { return "sub" }
+// detach a lagging SUB portal.  Unlike RemoveEndpoint, it leaves the SUB
+// portal open, so that it can still receive from other PUB portals.
+func (p *Protocol) detach(pe *pubEP) {
+	p.n.RemovePeer(pe.ID())
+
+	p.Lock()
+	delete(p.filters, pe.ID())
+	p.Unlock()
+
+	pe.detach()
+}
+
+// SetQueuePolicy sets the policy governing the queues of SUB portals that
+// connect later, unless they have their own (see SetPeerQueuePolicy)
+func (p *Protocol) SetQueuePolicy(qp QueuePolicy) {
+	p.Lock()
+	p.queuing = qp
+	p.Unlock()
+}
+
+// SetPeerQueuePolicy sets the policy governing the queue of a SUB portal.  It
+// must be called before the SUB portal connects.
+func (p *Protocol) SetPeerQueuePolicy(id portal.ID, qp QueuePolicy) {
+	p.Lock()
+	p.policies[id] = qp
+	p.Unlock()
+}
+
+// Lag reports how far each connected SUB portal lags behind
+func (p *Protocol) Lag() map[portal.ID]Lag {
+	m, done := p.n.RMap()
+	defer done()
+
+	lag := make(map[portal.ID]Lag, len(m))
+	for id, peer := range m {
+		lag[id] = peer.(*pubEP).lag()
+	}
+	return lag
+}
+
+func (*Protocol) Number() uint16     { return proto.Pub }
+func (*Protocol) PeerNumber() uint16 { return proto.Sub }
+func (*Protocol) Name() string       { return "pub" }
+func (*Protocol) PeerName() string   { return "sub" }
+
+// Portal is a PUB portal
+type Portal interface {
+	portal.WriteOnly
+
+	// SetCachePolicy sets the policy governing the messages retained for SUB
+	// portals that connect later, so that late joiners catch up.  Caching is
+	// disabled by default.  Previously retained messages are discarded.
+	SetCachePolicy(CachePolicy)
+
+	// SetQueuePolicy sets the policy governing the queues of SUB portals that
+	// connect later.  It defaults to a queue of the PUB portal's buffer size,
+	// subject to Cfg.Overflow.
+	SetQueuePolicy(QueuePolicy)
+
+	// SetPeerQueuePolicy overrides the queue policy of a SUB portal.  It must
+	// be called before the SUB portal connects.
+	SetPeerQueuePolicy(portal.ID, QueuePolicy)
+
+	// Lag reports how far each connected SUB portal lags behind
+	Lag() map[portal.ID]Lag
+}
+
+type pubPortal struct {
+	portal.WriteOnly
+	proto *Protocol
+}
+
+func (p pubPortal) SetCachePolicy(cp CachePolicy) { p.proto.SetCachePolicy(cp) }
+func (p pubPortal) SetQueuePolicy(qp QueuePolicy) { p.proto.SetQueuePolicy(qp) }
+
+func (p pubPortal) SetPeerQueuePolicy(id portal.ID, qp QueuePolicy) {
+	p.proto.SetPeerQueuePolicy(id, qp)
+}
+
+func (p pubPortal) Lag() map[portal.ID]Lag { return p.proto.Lag() }
 
 // New allocates a portal using the PUB protocol
-func New(cfg portal.Cfg) portal.WriteOnly {
-	return struct{ portal.WriteOnly }{portal.MakePortal(cfg, &Protocol{})} // write guard
+func New(cfg portal.Cfg) Portal {
+	p := &Protocol{}
+	return pubPortal{WriteOnly: portal.MakePortal(cfg, p), proto: p} // write guard
+}
+
+// NewOf allocates a type-safe portal using the PUB protocol
+func NewOf[T any](cfg portal.Cfg) portal.TypedWriteOnly[T] {
+	return portal.TypedWriteOnly[T]{WriteOnly: New(cfg)}
 }
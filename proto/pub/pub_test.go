@@ -0,0 +1,406 @@
+package pub
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/lthibault/portal/proto/sub"
+)
+
+func TestOverflow(t *testing.T) {
+	const iter = 100
+
+	p := New(portal.Cfg{Size: 1, Overflow: portal.DropNewest})
+	if err := p.Bind("/test/pub/overflow"); err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	fast, slow := sub.New(portal.Cfg{}), sub.New(portal.Cfg{})
+	for _, s := range []sub.Portal{fast, slow} {
+		if err := s.Subscribe(sub.TopicAll); err != nil {
+			t.Error(err)
+		}
+
+		if err := s.Connect("/test/pub/overflow"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	go func() {
+		for {
+			if _, err := fast.RecvErr(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ch := make(chan struct{})
+	go func() {
+		for i := 0; i < iter; i++ {
+			p.Send(i)
+		}
+		close(ch)
+	}()
+
+	select {
+	case <-ch:
+	case <-time.After(time.Millisecond * 100):
+		t.Error("slow subscriber blocked the publisher")
+	}
+}
+
+func TestPushdown(t *testing.T) {
+	const iter = 10
+
+	p := New(portal.Cfg{Size: iter})
+	if err := p.Bind("/test/pub/pushdown"); err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	a, b := sub.New(portal.Cfg{Size: iter}), sub.New(portal.Cfg{Size: iter})
+	for s, pattern := range map[sub.Portal]sub.Pattern{a: "a", b: "b"} {
+		if err := s.Subscribe(pattern); err != nil {
+			t.Error(err)
+		}
+
+		if err := s.Connect("/test/pub/pushdown"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 10) // let the subscriptions be advertised
+
+	publish := func() {
+		for i := 0; i < iter; i++ {
+			p.SendEnvelope(context.Background(), portal.Envelope{
+				Header: map[string]string{proto.HdrTopic: "a"},
+				Value:  i,
+			})
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	publish()
+	if _, n := a.Len(); n != iter {
+		t.Errorf("expected %d messages queued for subscriber, got %d", iter, n)
+	}
+	if _, n := b.Len(); n != 0 {
+		t.Errorf("%d messages sent to uninterested subscriber", n)
+	}
+
+	// subscriptions are updated
+	if err := b.Subscribe(sub.Pattern("a")); err != nil {
+		t.Error(err)
+	}
+
+	publish()
+	if _, n := b.Len(); n != iter {
+		t.Errorf("expected %d messages queued for subscriber, got %d", iter, n)
+	}
+}
+
+func TestCache(t *testing.T) {
+	recv := func(t *testing.T, s sub.Portal, expected ...interface{}) {
+		t.Helper()
+
+		for _, v := range expected {
+			c, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			u, err := s.RecvCtx(c)
+			cancel()
+
+			if err != nil {
+				t.Fatal(err)
+			} else if u != v {
+				t.Errorf("expected %v, got %v", v, u)
+			}
+		}
+
+		if u, ok := s.TryRecv(); ok {
+			t.Errorf("unexpected %v", u)
+		}
+	}
+
+	late := func(t *testing.T, addr string, topic sub.Topic) sub.Portal {
+		time.Sleep(time.Millisecond * 10) // let the messages be published
+
+		s := sub.New(portal.Cfg{Size: 8})
+		if err := s.Subscribe(topic); err != nil {
+			t.Error(err)
+		}
+		if err := s.Connect(addr); err != nil {
+			t.Error(err)
+		}
+		return s
+	}
+
+	t.Run("LastValue", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		p.SetCachePolicy(CachePolicy{LastValue: true})
+		if err := p.Bind("/test/pub/cache/lvc"); err != nil {
+			t.Error(err)
+		}
+		defer p.Close()
+
+		publish := func(topic string, v int) {
+			p.SendEnvelope(context.Background(), portal.Envelope{
+				Header: map[string]string{proto.HdrTopic: topic},
+				Value:  v,
+			})
+		}
+
+		publish("a", 1)
+		publish("b", 2)
+		publish("a", 3)
+		p.Send(4) // no topic
+
+		s := late(t, "/test/pub/cache/lvc", sub.Pattern("#"))
+		defer s.Close()
+
+		publish("b", 5)
+		recv(t, s, 2, 3, 5)
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		p.SetCachePolicy(CachePolicy{Replay: 2})
+		if err := p.Bind("/test/pub/cache/replay"); err != nil {
+			t.Error(err)
+		}
+		defer p.Close()
+
+		for i := 0; i < 5; i++ {
+			p.Send(i)
+		}
+
+		s := late(t, "/test/pub/cache/replay", sub.TopicAll)
+		defer s.Close()
+
+		p.Send(5)
+		recv(t, s, 3, 4, 5)
+	})
+
+	t.Run("Key", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		p.SetCachePolicy(CachePolicy{
+			LastValue: true,
+			Replay:    1,
+			Key: func(msg *portal.Message) (string, bool) {
+				return strconv.Itoa(msg.Value.(int) % 2), true
+			},
+		})
+		if err := p.Bind("/test/pub/cache/key"); err != nil {
+			t.Error(err)
+		}
+		defer p.Close()
+
+		for i := 0; i < 6; i++ {
+			p.Send(i)
+		}
+
+		s := late(t, "/test/pub/cache/key", sub.TopicAll)
+		defer s.Close()
+
+		recv(t, s, 4, 5) // 5 is both the last odd value and the last value
+	})
+}
+
+func TestQueuePolicy(t *testing.T) {
+	publish := func(p Portal, topic string, v int) {
+		p.SendEnvelope(context.Background(), portal.Envelope{
+			Header: map[string]string{proto.HdrTopic: topic},
+			Value:  v,
+		})
+	}
+
+	// connect an unbuffered SUB portal that does not receive, so that the
+	// messages published after the first two are queued by the PUB portal
+	stall := func(t *testing.T, p Portal, addr string) sub.Portal {
+		s := sub.New(portal.Cfg{})
+		if err := s.Subscribe(sub.Pattern("#")); err != nil {
+			t.Error(err)
+		}
+		if err := s.Connect(addr); err != nil {
+			t.Error(err)
+		}
+
+		time.Sleep(time.Millisecond * 10) // let the subscriptions be advertised
+
+		publish(p, "x", 1)
+		publish(p, "y", 2)
+		time.Sleep(time.Millisecond * 10) // let them reach the SUB portal
+		return s
+	}
+
+	t.Run("Conflate", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		p.SetQueuePolicy(QueuePolicy{Conflate: true})
+		if err := p.Bind("/test/pub/queue/conflate"); err != nil {
+			t.Error(err)
+		}
+		defer p.Close()
+
+		s := stall(t, p, "/test/pub/queue/conflate")
+		defer s.Close()
+
+		publish(p, "a", 3)
+		publish(p, "a", 4)
+		publish(p, "b", 5)
+		publish(p, "a", 6)
+		time.Sleep(time.Millisecond * 10)
+
+		if lag := p.Lag()[s.ID()]; lag.Queued != 2 || lag.Conflated != 2 {
+			t.Errorf("unexpected lag %+v", lag)
+		}
+
+		for _, expected := range []int{1, 2, 6, 5} {
+			c, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			v, err := s.RecvCtx(c)
+			cancel()
+
+			if err != nil {
+				t.Fatal(err)
+			} else if v != expected {
+				t.Errorf("expected %d, got %v", expected, v)
+			}
+		}
+	})
+
+	t.Run("Dropped", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		if err := p.Bind("/test/pub/queue/dropped"); err != nil {
+			t.Error(err)
+		}
+		defer p.Close()
+
+		fast := sub.New(portal.Cfg{Size: 8})
+		if err := fast.Subscribe(sub.TopicAll); err != nil {
+			t.Error(err)
+		}
+		if err := fast.Connect("/test/pub/queue/dropped"); err != nil {
+			t.Error(err)
+		}
+		defer fast.Close()
+
+		p.SetQueuePolicy(QueuePolicy{Size: 1, Overflow: portal.DropNewest})
+
+		s := stall(t, p, "/test/pub/queue/dropped")
+		defer s.Close()
+
+		for i := 3; i <= 6; i++ {
+			publish(p, "a", i)
+		}
+		time.Sleep(time.Millisecond * 10)
+
+		lag := p.Lag()
+		if l := lag[s.ID()]; l.Queued != 1 || l.Dropped != 3 {
+			t.Errorf("unexpected lag %+v", l)
+		}
+		if l := lag[fast.ID()]; l.Dropped != 0 {
+			t.Errorf("unexpected lag %+v for a SUB portal with the default policy", l)
+		}
+	})
+
+	// a detached SUB portal stays open, and receives nothing more from p
+	detached := func(t *testing.T, p Portal, s sub.Portal) {
+		deadline := time.Now().Add(time.Millisecond * 100)
+		for _, ok := p.Lag()[s.ID()]; ok; _, ok = p.Lag()[s.ID()] {
+			if time.Now().After(deadline) {
+				t.Fatal("lagging SUB portal still connected")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		publish(p, "a", -1)
+
+		c, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+
+		var v interface{}
+		var err error
+		for err == nil {
+			if v, err = s.RecvCtx(c); v == -1 {
+				t.Error("message delivered to a detached SUB portal")
+			}
+		}
+
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+		}
+	}
+
+	t.Run("MaxLag", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		p.SetQueuePolicy(QueuePolicy{Size: 1, Overflow: portal.DropNewest, MaxLag: 2})
+		if err := p.Bind("/test/pub/queue/maxlag"); err != nil {
+			t.Error(err)
+		}
+		defer p.Close()
+
+		s := stall(t, p, "/test/pub/queue/maxlag")
+		defer s.Close()
+
+		for i := 3; i <= 5; i++ {
+			publish(p, "a", i)
+		}
+		time.Sleep(time.Millisecond * 10)
+
+		if l, ok := p.Lag()[s.ID()]; !ok || l.Dropped != 2 {
+			t.Errorf("SUB portal disconnected before lagging by more than 2 messages (%+v)", l)
+		}
+
+		publish(p, "a", 6)
+		detached(t, p, s)
+
+		// the SUB portal can still receive from other PUB portals
+		other := New(portal.Cfg{})
+		if err := other.Bind("/test/pub/queue/maxlag/other"); err != nil {
+			t.Error(err)
+		}
+		defer other.Close()
+
+		if err := s.Connect("/test/pub/queue/maxlag/other"); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+
+		go publish(other, "b", 7)
+
+		c, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		if v, err := s.RecvCtx(c); err != nil {
+			t.Error(err)
+		} else if v != 7 {
+			t.Errorf("expected 7, got %v", v)
+		}
+	})
+
+	t.Run("MaxLatency", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		p.SetQueuePolicy(QueuePolicy{Size: 1, MaxLatency: time.Millisecond * 20})
+		if err := p.Bind("/test/pub/queue/maxlatency"); err != nil {
+			t.Error(err)
+		}
+		defer p.Close()
+
+		s := stall(t, p, "/test/pub/queue/maxlatency")
+		defer s.Close()
+
+		publish(p, "a", 3)
+		publish(p, "a", 4) // blocks the PUB portal until MaxLatency elapses
+		time.Sleep(time.Millisecond * 5)
+
+		if _, ok := p.Lag()[s.ID()]; !ok {
+			t.Error("SUB portal disconnected before MaxLatency elapsed")
+		}
+
+		detached(t, p, s)
+	})
+
+}
@@ -0,0 +1,332 @@
+package pub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SentimensRG/ctx"
+	"github.com/lthibault/portal"
+)
+
+// QueuePolicy governs the queue of messages awaiting delivery to a SUB portal.
+// Each SUB portal has its own queue, so that a slow subscriber does not stall
+// the others.
+type QueuePolicy struct {
+	// Size of the queue.  It defaults to the PUB portal's buffer size (minimum
+	// 1).
+	Size int
+
+	// Overflow policy applied when the queue is full.  The Callback policy
+	// passes messages to the PUB portal's Cfg.OnDrop.
+	Overflow portal.Overflow
+
+	// MaxLag disconnects the SUB portal from the PUB portal once more than
+	// MaxLag messages were discarded by Overflow since it last received a
+	// message.  The SUB portal itself stays open.  Zero disables it.
+	MaxLag int
+
+	// MaxLatency disconnects the SUB portal from the PUB portal once its queue
+	// was full for MaxLatency without it receiving a message.  With the Block
+	// policy, this bounds how long the PUB portal waits for it.  Zero disables
+	// it.
+	MaxLatency time.Duration
+
+	// Conflate retains only the newest queued message for each key.  The
+	// message takes the place of the first queued message with the same key.
+	// Messages without a key are queued as usual.
+	Conflate bool
+
+	// Key returns the key under which messages are conflated.  It defaults to
+	// the message's topic (see proto.HdrTopic and sub.Topical).  Key MUST NOT
+	// retain or modify the message.
+	Key func(*portal.Message) (string, bool)
+}
+
+func (qp QueuePolicy) key(msg *portal.Message) (string, bool) { return keyOf(qp.Key, msg) }
+
+// Lag reports how far a SUB portal lags behind the PUB portal
+type Lag struct {
+	// Queued is the number of messages awaiting delivery
+	Queued int
+
+	// Dropped is the number of messages discarded by the overflow policy
+	Dropped uint64
+
+	// Conflated is the number of messages superseded by a newer message with
+	// the same key before they were delivered
+	Conflated uint64
+
+	// Latency is the time elapsed between the publication and the delivery of
+	// the last message delivered
+	Latency time.Duration
+}
+
+// conflation tracks the newest message for a key.  The token is the message
+// that holds the key's place in the queue.
+type conflation struct{ token, latest *portal.Message }
+
+type pubEP struct {
+	portal.Endpoint
+	done     ctx.C         // fires when the SUB portal disconnects or is detached
+	detached chan struct{} // closed when the SUB portal lags too far behind
+	policy   QueuePolicy
+	onDrop   func(*portal.Message)
+	q        chan *portal.Message
+	snapshot []*portal.Message // retained messages, delivered first
+
+	sync.Mutex
+	pending map[string]*conflation
+
+	dropped, conflated uint64 // atomic
+	latency            int64  // atomic
+
+	// lag since the last delivery (atomic)
+	behind uint64 // messages discarded
+	full   int64  // when the queue was first found full, in nanoseconds
+}
+
+func newPubEP(ep portal.Endpoint, qp QueuePolicy, onDrop func(*portal.Message)) *pubEP {
+	detached := make(chan struct{})
+	return &pubEP{
+		Endpoint: ep,
+		done:     ctx.Link(ep, ctx.Lift(detached)),
+		detached: detached,
+		policy:   qp,
+		onDrop:   onDrop,
+		q:        make(chan *portal.Message, qp.Size),
+		pending:  make(map[string]*conflation),
+	}
+}
+
+func (pe *pubEP) startSending() {
+	rq := pe.RecvChannel()
+	cq := pe.done
+
+	defer pe.drain()
+
+	for i, msg := range pe.snapshot {
+		select {
+		case rq <- msg:
+		case <-cq:
+			for _, msg := range pe.snapshot[i:] {
+				msg.Free()
+			}
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-pe.q:
+			msg = pe.resolve(msg)
+			sent := msg.Sent
+
+			select {
+			case rq <- msg:
+				atomic.StoreInt64(&pe.latency, int64(time.Since(sent)))
+				atomic.StoreUint64(&pe.behind, 0)
+				atomic.StoreInt64(&pe.full, 0)
+			case <-cq:
+				msg.Free()
+				return
+			}
+		}
+	}
+}
+
+// enqueue msg, applying the queue policy.  It returns false if the SUB portal
+// must be disconnected.
+func (pe *pubEP) enqueue(msg *portal.Message) (connected bool) {
+	key, keyed := "", false
+	if pe.policy.Conflate {
+		if key, keyed = pe.policy.key(msg); keyed && pe.conflate(key, msg) {
+			return true
+		}
+	}
+
+	var queued bool
+	if queued, connected = pe.push(msg); !queued && keyed {
+		pe.Lock()
+		delete(pe.pending, key)
+		pe.Unlock()
+	}
+
+	select {
+	case <-pe.done:
+		pe.drain() // the SUB portal disconnected while msg was being queued
+	default:
+	}
+
+	return
+}
+
+// conflate replaces the newest queued message with the same key.  It returns
+// false if there is no such message, in which case msg must be queued.
+func (pe *pubEP) conflate(key string, msg *portal.Message) bool {
+	pe.Lock()
+	defer pe.Unlock()
+
+	if c, ok := pe.pending[key]; ok {
+		if c.latest != c.token {
+			c.latest.Free()
+		}
+		c.latest = msg
+		atomic.AddUint64(&pe.conflated, 1)
+		return true
+	}
+
+	pe.pending[key] = &conflation{token: msg, latest: msg}
+	return false
+}
+
+// push msg onto the queue, applying the overflow policy if it is full
+func (pe *pubEP) push(msg *portal.Message) (queued, connected bool) {
+	if pe.policy.Overflow == portal.Block {
+		select {
+		case pe.q <- msg:
+			return true, true
+		default:
+		}
+
+		var timeout <-chan time.Time
+		if pe.policy.MaxLatency > 0 {
+			t := time.NewTimer(pe.policy.MaxLatency - pe.stalled())
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case pe.q <- msg:
+			return true, true
+		case <-pe.done:
+			msg.Free()
+			return false, true
+		case <-timeout:
+			msg.Free()
+			return false, false
+		}
+	}
+
+	for {
+		select {
+		case pe.q <- msg:
+			return true, true
+		default:
+		}
+
+		switch pe.policy.Overflow {
+		case portal.DropOldest:
+			select {
+			case old := <-pe.q:
+				pe.discard(old)
+				atomic.AddUint64(&pe.dropped, 1)
+				if pe.lagging(atomic.AddUint64(&pe.behind, 1)) {
+					msg.Free()
+					return false, false
+				}
+			default: // the queue was emptied in the meantime
+			}
+			continue
+		case portal.Callback:
+			if pe.onDrop != nil {
+				pe.onDrop(msg)
+			}
+		}
+
+		atomic.AddUint64(&pe.dropped, 1)
+		msg.Free()
+		return false, !pe.lagging(atomic.AddUint64(&pe.behind, 1))
+	}
+}
+
+// stalled returns how long the queue has been full without a delivery.  The
+// queue must be full.
+func (pe *pubEP) stalled() time.Duration {
+	now := time.Now().UnixNano()
+	if atomic.CompareAndSwapInt64(&pe.full, 0, now) {
+		return 0
+	}
+	return time.Duration(now - atomic.LoadInt64(&pe.full))
+}
+
+// lagging reports whether the SUB portal lags too far behind, given the number
+// of messages discarded since its last delivery.  The queue must be full.
+func (pe *pubEP) lagging(behind uint64) bool {
+	if pe.policy.MaxLag > 0 && behind > uint64(pe.policy.MaxLag) {
+		return true
+	}
+
+	stalled := pe.stalled()
+	return pe.policy.MaxLatency > 0 && stalled >= pe.policy.MaxLatency
+}
+
+// detach the SUB portal from the PUB portal without closing it
+func (pe *pubEP) detach() { close(pe.detached) }
+
+// resolve returns the message to deliver in place of a dequeued message, i.e.
+// the newest message with the same key if the queue is conflated
+func (pe *pubEP) resolve(msg *portal.Message) *portal.Message {
+	c := pe.release(msg)
+	if c == nil {
+		return msg
+	}
+
+	if c.latest != msg {
+		msg.Free()
+	}
+	return c.latest
+}
+
+// discard a dequeued message, along with the newer message that superseded it
+func (pe *pubEP) discard(msg *portal.Message) {
+	if c := pe.release(msg); c != nil && c.latest != msg {
+		c.latest.Free()
+	}
+	msg.Free()
+}
+
+// release the key held by a dequeued message.  It returns nil if the message
+// does not hold a key.
+func (pe *pubEP) release(msg *portal.Message) *conflation {
+	if !pe.policy.Conflate {
+		return nil
+	}
+
+	key, ok := pe.policy.key(msg)
+	if !ok {
+		return nil
+	}
+
+	pe.Lock()
+	defer pe.Unlock()
+
+	if c, ok := pe.pending[key]; ok && c.token == msg {
+		delete(pe.pending, key)
+		return c
+	}
+	return nil
+}
+
+// drain frees messages that can no longer be delivered
+func (pe *pubEP) drain() {
+	for {
+		select {
+		case msg := <-pe.q:
+			pe.discard(msg)
+		default:
+			return
+		}
+	}
+}
+
+func (pe *pubEP) lag() Lag {
+	return Lag{
+		Queued:    len(pe.q),
+		Dropped:   atomic.LoadUint64(&pe.dropped),
+		Conflated: atomic.LoadUint64(&pe.conflated),
+		Latency:   time.Duration(atomic.LoadInt64(&pe.latency)),
+	}
+}
@@ -0,0 +1,74 @@
+package pull
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/pkg/errors"
+)
+
+// ErrProducerGone is returned when acknowledging a message whose PUSH portal
+// has disconnected
+var ErrProducerGone = errors.New("producer disconnected")
+
+// Delivery is a message received from a PUSH portal.  If the PUSH portal
+// requires acknowledgements (see push.AckPolicy), the message MUST be either
+// acknowledged or rejected, or it is redelivered once its visibility timeout
+// expires.
+type Delivery struct {
+	portal.Envelope
+
+	// Attempt is 1 for the first delivery of a message, 2 for its first
+	// redelivery, and so on.  It is 0 if the message need not be
+	// acknowledged.
+	Attempt int
+
+	proto *Protocol
+}
+
+// Ack acknowledges that the message was processed
+func (d Delivery) Ack() error { return d.settle(proto.HdrAck) }
+
+// Nack rejects the message, which is redelivered immediately (preferably to
+// another PULL portal), or sent to the dead-letter address if it has been
+// delivered too many times
+func (d Delivery) Nack() error { return d.settle(proto.HdrNack) }
+
+func (d Delivery) settle(hdr string) error {
+	if d.Attempt == 0 {
+		return nil
+	}
+
+	ep, ok := d.proto.endpoint(d.From)
+	if !ok {
+		return ErrProducerGone
+	}
+
+	from := d.proto.ptl.ID()
+
+	msg := portal.NewMsg()
+	msg.From = &from
+	msg.ReplyTo = d.ID
+	msg.Header = map[string]string{hdr: strconv.Itoa(d.Attempt)}
+
+	if !proto.Deliver(ep, msg, d.proto.ptl.CloseChannel()) {
+		return ErrProducerGone
+	}
+	return nil
+}
+
+// recvDelivery receives a message that may require acknowledgement
+func (p *Protocol) recvDelivery(c context.Context, ptl portal.ReadOnly) (Delivery, error) {
+	env, err := ptl.RecvEnvelope(c)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	d := Delivery{Envelope: env, proto: p}
+	if v, ok := env.Header[proto.HdrDelivery]; ok {
+		d.Attempt, _ = strconv.Atoi(v)
+	}
+	return d, nil
+}
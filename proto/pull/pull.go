@@ -1,42 +1,328 @@
 package pull
 
 import (
+	"context"
+	"sync"
+
 	"github.com/lthibault/portal"
 	"github.com/lthibault/portal/proto"
 )
 
+// producer is the queue of messages received from a PUSH portal
+type producer struct {
+	id     portal.ID
+	ep     portal.Endpoint // nil until the PUSH portal is connected
+	q      chan *portal.Message
+	in     chan *portal.Message // the PUSH portal's own intake; nil unless Block
+	quit   chan struct{}        // stops forwarding from in once the PUSH portal disconnects
+	credit int                  // messages that may still be dequeued during this turn
+	gone   bool                 // the PUSH portal disconnected
+}
+
 // Protocol implementing PULL
-type Protocol struct{ ptl portal.ProtocolPortal }
+type Protocol struct {
+	ptl portal.ProtocolPortal
+
+	sync.Mutex
+	producers map[portal.ID]*producer
+	order     []*producer // round-robin order
+	cur       int
+	weights   map[portal.ID]int
+	quotas    map[portal.ID]int
+	ready     chan struct{} // signalled when a message is queued
+}
 
 // Init the PULL protocol
-func (p *Protocol) Init(ptl portal.ProtocolPortal) { p.ptl = ptl }
+func (p *Protocol) Init(ptl portal.ProtocolPortal) {
+	p.ptl = ptl
+	p.producers = make(map[portal.ID]*producer)
+	p.weights = make(map[portal.ID]int)
+	p.quotas = make(map[portal.ID]int)
+	p.ready = make(chan struct{}, 1)
+	go p.startReceiving()
+}
 
-func (p Protocol) startReceiving(ep portal.Endpoint) {
-	rq := p.ptl.RecvChannel()
+// Intake queues messages by PUSH portal, so that they can be received in
+// weighted round-robin order.  A PUSH portal that sends faster than the others
+// cannot monopolise the receive queue.
+func (p *Protocol) Intake(in <-chan *portal.Message) { go p.startQueueing(in) }
+
+func (p *Protocol) startQueueing(in <-chan *portal.Message) {
+	cq := p.ptl.CloseChannel()
+	cfg := p.ptl.Config()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-in:
+			var id portal.ID
+			if msg.From != nil {
+				id = *msg.From
+			}
+
+			// Each PUSH portal has its own queue, so that the overflow policy
+			// only affects the PUSH portals that exceed their quota.
+			if cfg.Enqueue(p.producer(id).q, msg, cq) {
+				select {
+				case p.ready <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// PeerIntake gives each PUSH portal its own intake when the overflow policy is
+// Block, so that a PUSH portal that exceeds its quota is blocked without holding
+// up the others.  Other policies never wait, and use the shared intake.
+func (p *Protocol) PeerIntake(id portal.ID) chan<- *portal.Message {
+	if p.ptl.Config().Overflow != portal.Block {
+		return nil
+	}
+
+	pr := p.producer(id)
+
+	p.Lock()
+	defer p.Unlock()
+
+	if pr.in == nil {
+		pr.in, pr.quit = make(chan *portal.Message), make(chan struct{})
+		go p.startForwarding(pr.q, pr.in, pr.quit)
+	}
+	return pr.in
+}
+
+// startForwarding queues the messages of a single PUSH portal
+func (p *Protocol) startForwarding(q chan<- *portal.Message, in <-chan *portal.Message, quit <-chan struct{}) {
 	cq := p.ptl.CloseChannel()
 
-	for msg := range ep.SendChannel() {
+	for {
 		select {
 		case <-cq:
 			return
+		case <-quit:
+			return
+		case msg := <-in:
+			select {
+			case q <- msg:
+			case <-cq:
+				msg.Free()
+				return
+			}
+
+			select {
+			case p.ready <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (p *Protocol) startReceiving() {
+	rq := p.ptl.RecvChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		msg := p.next()
+		if msg == nil {
+			select {
+			case <-cq:
+				return
+			case <-p.ready:
+				continue
+			}
+		}
+
+		select {
 		case rq <- msg:
+		case <-cq:
+			msg.Free()
+			return
 		}
 	}
 }
 
-func (Protocol) Number() uint16                    { return proto.Pull }
-func (Protocol) Name() string                      { return "pull" }
-func (Protocol) PeerNumber() uint16                { return proto.Push }
-func (Protocol) PeerName() string                  { return "push" }
-func (Protocol) RemoveEndpoint(ep portal.Endpoint) {}
+// producer returns the queue of a PUSH portal, creating it if necessary
+func (p *Protocol) producer(id portal.ID) *producer {
+	p.Lock()
+	defer p.Unlock()
+
+	pr, ok := p.producers[id]
+	if !ok {
+		n := p.quotas[id]
+		if n < 1 {
+			n = proto.QueueSize(p.ptl)
+		}
+
+		pr = &producer{id: id, q: make(chan *portal.Message, n)}
+		p.producers[id] = pr
+		p.order = append(p.order, pr)
+	}
+
+	return pr
+}
+
+// endpoint returns the endpoint of a connected PUSH portal
+func (p *Protocol) endpoint(id portal.ID) (portal.Endpoint, bool) {
+	p.Lock()
+	defer p.Unlock()
 
-func (p Protocol) AddEndpoint(ep portal.Endpoint) {
+	if pr, ok := p.producers[id]; ok && pr.ep != nil {
+		return pr.ep, true
+	}
+	return nil, false
+}
+
+// next dequeues a message in weighted round-robin order.  It returns nil if
+// no message is queued.
+func (p *Protocol) next() *portal.Message {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.order) == 0 {
+		return nil // no PUSH portal has connected yet
+	}
+
+	for n := 0; n <= len(p.order); n++ {
+		pr := p.order[p.cur]
+		if pr.credit > 0 {
+			select {
+			case msg := <-pr.q:
+				pr.credit--
+				return msg
+			default:
+			}
+		}
+
+		p.advance()
+	}
+
+	return nil
+}
+
+// advance ends the current turn, discarding the queue of the current PUSH
+// portal if it disconnected and has no messages left.  The caller must hold
+// the lock.
+func (p *Protocol) advance() {
+	if len(p.order) == 0 {
+		return
+	}
+
+	pr := p.order[p.cur]
+	pr.credit = 0
+
+	if pr.gone && len(pr.q) == 0 {
+		delete(p.producers, pr.id)
+		p.order = append(p.order[:p.cur], p.order[p.cur+1:]...)
+	} else {
+		p.cur++
+	}
+
+	if len(p.order) == 0 {
+		p.cur = 0
+		return
+	}
+
+	p.cur %= len(p.order)
+	p.order[p.cur].credit = p.weight(p.order[p.cur].id)
+}
+
+// weight of a PUSH portal.  The caller must hold the lock.
+func (p *Protocol) weight(id portal.ID) int {
+	if w := p.weights[id]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (*Protocol) Number() uint16     { return proto.Pull }
+func (*Protocol) Name() string       { return "pull" }
+func (*Protocol) PeerNumber() uint16 { return proto.Push }
+func (*Protocol) PeerName() string   { return "push" }
+
+// AddEndpoint checks compatibility.  PUSH portals deliver messages directly to
+// the intake queue, in accordance with their Strategy.
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
 	proto.MustBeCompatible(p, ep.Signature())
-	go p.startReceiving(ep)
+
+	pr := p.producer(ep.ID())
+	p.Lock()
+	pr.ep, pr.gone = ep, false
+	p.Unlock()
+}
+
+// RemoveEndpoint discards the queue of a PUSH portal once the messages it
+// holds have been received
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) {
+	p.Lock()
+	if pr, ok := p.producers[ep.ID()]; ok {
+		pr.ep, pr.gone = nil, true
+		if pr.in != nil {
+			close(pr.quit)
+			pr.in, pr.quit = nil, nil
+		}
+	}
+	p.Unlock()
+}
+
+// SetWeight sets the number of consecutive messages received from a PUSH
+// portal during each round
+func (p *Protocol) SetWeight(id portal.ID, w int) {
+	p.Lock()
+	p.weights[id] = w
+	p.Unlock()
+}
+
+// SetQuota sets the maximum number of messages from a PUSH portal that may be
+// queued before the overflow policy applies
+func (p *Protocol) SetQuota(id portal.ID, n int) {
+	p.Lock()
+	p.quotas[id] = n
+	p.Unlock()
 }
 
+// Portal is a PULL portal.  Messages from connected PUSH portals are received
+// in weighted round-robin order.
+type Portal interface {
+	portal.ReadOnly
+
+	// RecvDelivery is like RecvEnvelope, but returns a Delivery with which the
+	// message can be acknowledged or rejected
+	RecvDelivery(context.Context) (Delivery, error)
+
+	// SetWeight sets the number of consecutive messages received from a PUSH
+	// portal during each round.  Weights default to 1; weights lower than 1
+	// restore the default.
+	SetWeight(portal.ID, int)
+
+	// SetQuota sets the maximum number of messages from a PUSH portal that may
+	// be queued by the PULL portal.  Messages beyond the quota are subject to
+	// Cfg.Overflow; the default policy blocks the PUSH portal, but not the
+	// others.  Quotas default to the portal's buffer size (minimum 1), and
+	// apply to PUSH portals that connect after SetQuota is called.
+	SetQuota(portal.ID, int)
+}
+
+type pullPortal struct {
+	portal.ReadOnly
+	proto *Protocol
+}
+
+func (p pullPortal) RecvDelivery(c context.Context) (Delivery, error) {
+	return p.proto.recvDelivery(c, p.ReadOnly)
+}
+
+func (p pullPortal) SetWeight(id portal.ID, w int) { p.proto.SetWeight(id, w) }
+func (p pullPortal) SetQuota(id portal.ID, n int)  { p.proto.SetQuota(id, n) }
+
 // New allocates a Portal using the PULL protocol
-func New(cfg portal.Cfg) portal.ReadOnly {
-	return struct{ portal.ReadOnly }{portal.MakePortal(cfg, &Protocol{})} // read guard
+func New(cfg portal.Cfg) Portal {
+	p := &Protocol{}
+	return pullPortal{ReadOnly: portal.MakePortal(cfg, p), proto: p} // read guard
+}
 
+// NewOf allocates a type-safe Portal using the PULL protocol
+func NewOf[T any](cfg portal.Cfg) portal.TypedReadOnly[T] {
+	return portal.TypedReadOnly[T]{ReadOnly: New(cfg)}
 }
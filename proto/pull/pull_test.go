@@ -0,0 +1,264 @@
+package pull
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/lthibault/portal/proto/push"
+)
+
+// producers connects a chatty and a quiet PUSH portal to the PULL portal, and
+// has them send nChatty and nQuiet messages respectively
+func producers(t *testing.T, p Portal, addr string, nChatty, nQuiet int) (chatty, quiet portal.ID) {
+	if err := p.Bind(addr); err != nil {
+		t.Error(err)
+	}
+
+	c, q := push.New(portal.Cfg{Size: nChatty}), push.New(portal.Cfg{Size: nQuiet})
+	p.SetQuota(c.ID(), nChatty)
+	p.SetQuota(q.ID(), nQuiet)
+
+	for _, ptl := range []push.Portal{c, q} {
+		if err := ptl.Connect(addr); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 0; i < nChatty; i++ {
+		c.Send(i)
+	}
+	for i := 0; i < nQuiet; i++ {
+		q.Send(i)
+	}
+
+	time.Sleep(time.Millisecond * 20) // let the messages reach their queues
+	return c.ID(), q.ID()
+}
+
+// recv returns the number of messages received from the quiet PUSH portal
+// among the first n messages (or all messages if n is zero)
+func recv(t *testing.T, p Portal, quiet portal.ID, n int) (nQuiet, total int) {
+	for n == 0 || total < n {
+		c, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		env, err := p.RecvEnvelope(c)
+		cancel()
+
+		if err != nil {
+			if n != 0 {
+				t.Errorf("message %d: %s", total, err)
+			}
+			return
+		}
+
+		if total++; env.From == quiet {
+			nQuiet++
+		}
+	}
+	return
+}
+
+func TestNoProducers(t *testing.T) {
+	p := New(portal.Cfg{})
+	if err := p.Bind("/test/pull/idle"); err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	time.Sleep(time.Millisecond * 10) // the receiving goroutine must not panic
+
+	c, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	if _, err := p.RecvCtx(c); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFairQueueing(t *testing.T) {
+	t.Run("RoundRobin", func(t *testing.T) {
+		p := New(portal.Cfg{})
+		_, quiet := producers(t, p, "/test/pull/roundrobin", 100, 10)
+
+		if n, _ := recv(t, p, quiet, 21); n != 10 {
+			t.Errorf("expected 10 quiet messages among the first 21, got %d", n)
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		p := New(portal.Cfg{})
+		p.SetWeight(portal.NewID(), 0) // unrelated weights have no effect
+		chatty, quiet := producers(t, p, "/test/pull/weighted", 100, 10)
+		p.SetWeight(chatty, 3)
+
+		if n, _ := recv(t, p, quiet, 44); n != 10 {
+			t.Errorf("expected 10 quiet messages among the first 44, got %d", n)
+		}
+	})
+
+	t.Run("DefaultQuota", func(t *testing.T) {
+		p := New(portal.Cfg{})
+		if err := p.Bind("/test/pull/defaultquota"); err != nil {
+			t.Error(err)
+		}
+
+		// both queues are full after their first message, which must not
+		// stop the quiet PUSH portal's messages from being queued
+		c, q := push.New(portal.Cfg{Size: 100}), push.New(portal.Cfg{Size: 10})
+		for _, ptl := range []push.Portal{c, q} {
+			if err := ptl.Connect("/test/pull/defaultquota"); err != nil {
+				t.Error(err)
+			}
+		}
+
+		for i := 0; i < 100; i++ {
+			c.Send(i)
+		}
+		time.Sleep(time.Millisecond * 10)
+		for i := 0; i < 10; i++ {
+			q.Send(i)
+		}
+		time.Sleep(time.Millisecond * 20)
+
+		if n, _ := recv(t, p, q.ID(), 21); n != 10 {
+			t.Errorf("expected 10 quiet messages among the first 21, got %d", n)
+		}
+	})
+
+	t.Run("Quota", func(t *testing.T) {
+		const quota = 5
+
+		p := New(portal.Cfg{Overflow: portal.DropNewest})
+		chatty := push.New(portal.Cfg{Size: 100})
+		p.SetQuota(chatty.ID(), quota)
+
+		if err := p.Bind("/test/pull/quota"); err != nil {
+			t.Error(err)
+		}
+		if err := chatty.Connect("/test/pull/quota"); err != nil {
+			t.Error(err)
+		}
+
+		for i := 0; i < 100; i++ {
+			chatty.Send(i)
+		}
+		time.Sleep(time.Millisecond * 20)
+
+		// one message may be waiting to be received, in addition to the quota
+		if _, n := recv(t, p, portal.ID{}, 0); n == 0 || n > quota+1 {
+			t.Errorf("expected at most %d messages, got %d", quota+1, n)
+		}
+	})
+}
+
+func TestAck(t *testing.T) {
+	recv := func(t *testing.T, p Portal) Delivery {
+		t.Helper()
+
+		c, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+
+		d, err := p.RecvDelivery(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	expectNone := func(t *testing.T, ps ...Portal) {
+		for _, p := range ps {
+			if v, ok := p.TryRecv(); ok {
+				t.Errorf("unexpected delivery of %v", v)
+			}
+		}
+	}
+
+	workers := func(t *testing.T, addr string, ap push.AckPolicy) (push.Portal, Portal, Portal) {
+		p := push.New(portal.Cfg{Size: 8})
+		if err := p.Bind(addr); err != nil {
+			t.Error(err)
+		}
+		if err := p.SetAckPolicy(ap); err != nil {
+			t.Error(err)
+		}
+
+		a, b := New(portal.Cfg{}), New(portal.Cfg{})
+		for _, ptl := range []Portal{a, b} {
+			if err := ptl.Connect(addr); err != nil {
+				t.Error(err)
+			}
+		}
+
+		return p, a, b
+	}
+
+	t.Run("Redeliver", func(t *testing.T) {
+		p, a, b := workers(t, "/test/pull/ack/redeliver", push.AckPolicy{
+			VisibilityTimeout: time.Millisecond * 20,
+		})
+		p.Send(true)
+
+		// the first delivery is round-robined to b, and never acknowledged
+		if d := recv(t, b); d.Attempt != 1 {
+			t.Errorf("expected attempt 1, got %d", d.Attempt)
+		}
+
+		d := recv(t, a)
+		if d.Attempt != 2 {
+			t.Errorf("expected attempt 2, got %d", d.Attempt)
+		}
+		if err := d.Ack(); err != nil {
+			t.Error(err)
+		}
+
+		time.Sleep(time.Millisecond * 50)
+		expectNone(t, a, b)
+	})
+
+	t.Run("DeadLetter", func(t *testing.T) {
+		dlq := New(portal.Cfg{})
+		if err := dlq.Bind("/test/pull/ack/dlq"); err != nil {
+			t.Error(err)
+		}
+
+		p, a, b := workers(t, "/test/pull/ack/nack", push.AckPolicy{
+			VisibilityTimeout: time.Second,
+			MaxDeliveries:     2,
+			DeadLetter:        "/test/pull/ack/dlq",
+		})
+		p.Send(true)
+
+		for i, ptl := range []Portal{b, a} {
+			if d := recv(t, ptl); d.Attempt != i+1 {
+				t.Errorf("expected attempt %d, got %d", i+1, d.Attempt)
+			} else if err := d.Nack(); err != nil {
+				t.Error(err)
+			}
+		}
+
+		if d := recv(t, dlq); d.Header[proto.HdrDelivery] != "2" {
+			t.Errorf("expected 2 deliveries, got %s", d.Header[proto.HdrDelivery])
+		} else if d.Value != true {
+			t.Errorf("unexpected dead letter %v", d.Value)
+		}
+		expectNone(t, a, b)
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		p, a, b := workers(t, "/test/pull/ack/disconnect", push.AckPolicy{
+			VisibilityTimeout: time.Second,
+		})
+		p.Send(true)
+
+		recv(t, b)
+		b.Close()
+
+		if d := recv(t, a); d.Attempt != 2 {
+			t.Errorf("expected attempt 2, got %d", d.Attempt)
+		} else if err := d.Ack(); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package push
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/SentimensRG/ctx"
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+)
+
+// AckPolicy governs the acknowledgement of messages by PULL portals (see
+// pull.Delivery).  The zero value disables acknowledgements.
+type AckPolicy struct {
+	// VisibilityTimeout is the duration after which a message that was
+	// neither acknowledged nor rejected is redelivered, preferably to another
+	// PULL portal
+	VisibilityTimeout time.Duration
+
+	// MaxDeliveries bounds the number of times a message is delivered.  Zero
+	// means no limit.
+	MaxDeliveries int
+
+	// DeadLetter is the address of a PULL portal to which messages are sent
+	// once they have been delivered MaxDeliveries times.  If it is empty, such
+	// messages are dropped.
+	DeadLetter string
+}
+
+func (ap AckPolicy) enabled() bool { return ap.VisibilityTimeout > 0 }
+
+func (ap AckPolicy) exhausted(deliveries int) bool {
+	return ap.MaxDeliveries > 0 && deliveries >= ap.MaxDeliveries
+}
+
+// work is a message awaiting acknowledgement
+type work struct {
+	id         uint64
+	from       *portal.ID
+	header     map[string]string
+	value      interface{}
+	deliveries int
+	peer       portal.ID
+	timer      *time.Timer
+}
+
+// headers returns the message's header, including the delivery count
+func (w *work) headers() map[string]string {
+	h := make(map[string]string, len(w.header)+1)
+	for k, v := range w.header {
+		h[k] = v
+	}
+	h[proto.HdrDelivery] = strconv.Itoa(w.deliveries)
+	return h
+}
+
+// msg returns a copy of the message, for redelivery
+func (w *work) msg() *portal.Message {
+	msg := portal.NewMsg()
+	msg.ID = w.id
+	msg.From = w.from
+	msg.Header = w.headers()
+	msg.Sent = time.Now()
+	msg.Value = w.value
+	return msg
+}
+
+// stop the visibility timer.  The caller must hold the lock.
+func (w *work) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Intake processes acknowledgements sent by PULL portals
+func (p *Protocol) Intake(in <-chan *portal.Message) { go p.startAcking(in) }
+
+func (p *Protocol) startAcking(in <-chan *portal.Message) {
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-in:
+			if _, ok := msg.Header[proto.HdrAck]; ok {
+				p.ack(msg.ReplyTo)
+			} else if v, ok := msg.Header[proto.HdrNack]; ok {
+				n, _ := strconv.Atoi(v)
+				p.redeliver(msg.ReplyTo, n)
+			}
+			msg.Free()
+		}
+	}
+}
+
+// track a message that must be acknowledged.  Its first delivery is recorded
+// in its header.
+func (p *Protocol) track(msg *portal.Message) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.acking.enabled() {
+		return
+	}
+
+	w := &work{id: msg.ID, from: msg.From, header: msg.Header, value: msg.Value, deliveries: 1}
+	msg.Header = w.headers()
+	p.works[w.id] = w
+}
+
+// delivered arms the visibility timer of a message that was queued for a PULL
+// portal
+func (p *Protocol) delivered(id uint64, peer portal.ID) {
+	p.Lock()
+	defer p.Unlock()
+
+	w, ok := p.works[id]
+	if !ok {
+		return
+	} else if !p.acking.enabled() {
+		delete(p.works, id) // acknowledgements were disabled in the meantime
+		return
+	}
+
+	w.stop()
+	w.peer = peer
+
+	n := w.deliveries
+	w.timer = time.AfterFunc(p.acking.VisibilityTimeout, func() { p.redeliver(id, n) })
+}
+
+// ack discards an acknowledged message
+func (p *Protocol) ack(id uint64) {
+	p.Lock()
+	defer p.Unlock()
+
+	if w, ok := p.works[id]; ok {
+		w.stop()
+		delete(p.works, id)
+	}
+}
+
+// redeliver a message whose nth delivery expired or was rejected.  Messages
+// that have since been redelivered are ignored.  Messages that have been
+// delivered MaxDeliveries times are sent to the dead-letter address.
+func (p *Protocol) redeliver(id uint64, n int) {
+	p.Lock()
+	w, ok := p.works[id]
+	if !ok || w.deliveries != n {
+		p.Unlock()
+		return
+	}
+
+	w.stop()
+
+	if p.acking.exhausted(w.deliveries) {
+		delete(p.works, id)
+		dlq := p.dlq
+		p.Unlock()
+
+		if dlq != nil {
+			go dlq.SendEnvelope(context.Background(), portal.Envelope{
+				Header: w.headers(),
+				Value:  w.value,
+			})
+		}
+		return
+	}
+
+	w.timer = nil // not delivered until dispatched again
+	w.deliveries++
+	peer, msg := w.peer, w.msg()
+	p.Unlock()
+
+	go p.dispatch(p.ptl.Config(), msg, p.ptl.CloseChannel(), &peer)
+}
+
+// redeliverAll redelivers the messages awaiting acknowledgement by a PULL
+// portal
+func (p *Protocol) redeliverAll(peer portal.ID) {
+	type delivery struct {
+		id uint64
+		n  int
+	}
+
+	var ds []delivery
+
+	p.Lock()
+	for _, w := range p.works {
+		if w.peer == peer && w.timer != nil {
+			ds = append(ds, delivery{w.id, w.deliveries})
+		}
+	}
+	p.Unlock()
+
+	for _, d := range ds {
+		p.redeliver(d.id, d.n)
+	}
+}
+
+// SetAckPolicy sets the policy governing the acknowledgement and redelivery of
+// messages.  It returns an error if the dead-letter address cannot be connected
+// to.
+func (p *Protocol) SetAckPolicy(ap AckPolicy) error {
+	var dlq portal.WriteOnly
+	if ap.DeadLetter != "" {
+		dlq = New(portal.Cfg{
+			Doner: ctx.Lift(p.ptl.CloseChannel()),
+			Size:  proto.QueueSize(p.ptl),
+		})
+
+		if err := dlq.Connect(ap.DeadLetter); err != nil {
+			dlq.Close()
+			return err
+		}
+	}
+
+	p.Lock()
+	old := p.dlq
+	p.acking, p.dlq = ap, dlq
+	p.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
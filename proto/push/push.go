@@ -1,57 +1,289 @@
 package push
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
+
 	"github.com/SentimensRG/ctx"
 	"github.com/lthibault/portal"
 	"github.com/lthibault/portal/proto"
 )
 
+type pushEP struct {
+	portal.Endpoint
+	done     ctx.C                  // fires when the PULL portal disconnects or the PUSH portal closes
+	rq       chan<- *portal.Message // the PULL portal's intake for this PUSH portal
+	q        chan *portal.Message
+	inflight int32 // 1 while a message is being delivered (atomic)
+	current  int   // smooth weighted round-robin state; guarded by the protocol
+}
+
+func (pe *pushEP) startSending(cq <-chan struct{}, drained chan<- struct{}) {
+	defer pe.drain()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case <-pe.Done():
+			return
+		case msg := <-pe.q:
+			atomic.StoreInt32(&pe.inflight, 1)
+			ok := proto.Deliver(pe, msg, cq)
+			atomic.StoreInt32(&pe.inflight, 0)
+
+			if !ok {
+				return
+			}
+
+			select {
+			case drained <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (pe *pushEP) RecvChannel() chan<- *portal.Message { return pe.rq }
+
+// drain frees messages that can no longer be delivered
+func (pe *pushEP) drain() {
+	for {
+		select {
+		case msg := <-pe.q:
+			msg.Free()
+		default:
+			return
+		}
+	}
+}
+
+// queued reports whether a message that was queued for the PULL portal can
+// still be delivered.  Otherwise, the queue is drained.
+func (pe *pushEP) queued(cq <-chan struct{}) bool {
+	select {
+	case <-cq:
+	case <-pe.Done():
+	default:
+		return true
+	}
+
+	pe.drain() // the PUSH portal closed or the PULL portal disconnected
+	return false
+}
+
 // Protocol implementing PUSH
 type Protocol struct {
 	ptl portal.ProtocolPortal
-	n   proto.Neighborhood
+
+	sync.Mutex
+	strategy Strategy
+	peers    []*pushEP
+	next     int
+	weights  map[portal.ID]int
+	ring     ring
+	joined   chan struct{} // closed when a PULL portal connects
+	drained  chan struct{} // signalled when a message is delivered
+
+	acking AckPolicy
+	works  map[uint64]*work
+	dlq    portal.WriteOnly
 }
 
 // Init the PUSH protocol
 func (p *Protocol) Init(ptl portal.ProtocolPortal) {
 	close(ptl.RecvChannel()) // NOTE : if mysterious error, maybe it's this?
 	p.ptl = ptl
-	p.n = proto.NewNeighborhood()
+	p.weights = make(map[portal.ID]int)
+	p.joined = make(chan struct{})
+	p.drained = make(chan struct{}, 1)
+	p.works = make(map[uint64]*work)
+	go p.startSending()
 }
 
-func (p Protocol) startSending(pe portal.Endpoint) {
+func (p *Protocol) startSending() {
 	sq := p.ptl.SendChannel()
-	rq := pe.RecvChannel()
-	cq := ctx.Link(ctx.Lift(p.ptl.CloseChannel()), pe)
+	cq := p.ptl.CloseChannel()
+	cfg := p.ptl.Config()
 
 	for {
 		select {
 		case <-cq:
 			return
-		case msg, ok := <-sq:
-			if !ok {
-				sq = p.ptl.SendChannel()
-			} else {
-				rq <- msg
+		case msg := <-sq:
+			p.track(msg)
+			if !p.dispatch(cfg, msg, cq, nil) {
+				return
 			}
 		}
 	}
 }
 
-func (Protocol) Number() uint16     { return proto.Push }
-func (Protocol) Name() string       { return "push" }
-func (Protocol) PeerNumber() uint16 { return proto.Pull }
-func (Protocol) PeerName() string   { return "pull" }
+// dispatch enqueues msg for the PULL portal chosen by the strategy, waiting
+// for one to connect if necessary.  If possible, the message is not sent to
+// the PULL portal identified by avoid.  It returns false if cq fired first.
+func (p *Protocol) dispatch(cfg portal.Cfg, msg *portal.Message, cq <-chan struct{}, avoid *portal.ID) bool {
+	for {
+		p.Lock()
+		pe := p.pick(msg)
+		for n := 1; avoid != nil && pe != nil && pe.ID() == *avoid && n < len(p.peers); n++ {
+			pe = p.roundRobin()
+		}
+		flexible := p.strategy == LeastLoaded
+		joined := p.joined
+		p.Unlock()
 
-func (p Protocol) AddEndpoint(ep portal.Endpoint) {
+		wait := joined
+		if pe != nil {
+			// Messages that must be acknowledged are redelivered if they are
+			// dropped, so the delivery is recorded beforehand.
+			p.delivered(msg.ID, pe.ID())
+
+			// Under LeastLoaded, a full queue means that every queue is full.
+			// Rather than committing to one PULL portal, wait for any of them
+			// to make room.
+			if !flexible || cfg.Overflow != portal.Block {
+				if !cfg.Enqueue(pe.q, msg, pe.done) || !pe.queued(cq) {
+					return !closed(cq)
+				}
+				return true
+			}
+
+			select {
+			case pe.q <- msg:
+				if !pe.queued(cq) {
+					return !closed(cq)
+				}
+				return true
+			default:
+				wait = p.drained
+			}
+		}
+
+		select {
+		case <-cq:
+			msg.Free()
+			return false
+		case <-joined:
+		case <-wait:
+		}
+	}
+}
+
+// closed reports whether the PUSH portal was closed
+func closed(cq <-chan struct{}) bool {
+	select {
+	case <-cq:
+		return true
+	default:
+		return false
+	}
+}
+
+func (*Protocol) Number() uint16     { return proto.Push }
+func (*Protocol) Name() string       { return "push" }
+func (*Protocol) PeerNumber() uint16 { return proto.Pull }
+func (*Protocol) PeerName() string   { return "pull" }
+
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
 	proto.MustBeCompatible(p, ep.Signature())
-	p.n.SetPeer(ep.ID(), ep)
-	go p.startSending(ep)
+
+	pe := &pushEP{
+		Endpoint: ep,
+		done:     ctx.Link(ep, ctx.Lift(p.ptl.CloseChannel())),
+		rq:       proto.PeerRecvChannel(ep, p.ptl.ID()),
+		q:        make(chan *portal.Message, proto.QueueSize(p.ptl)),
+	}
+
+	p.Lock()
+	p.peers = append(p.peers, pe)
+	p.ring = newRing(p.peers)
+	close(p.joined)
+	p.joined = make(chan struct{})
+	p.Unlock()
+
+	go pe.startSending(p.ptl.CloseChannel(), p.drained)
+}
+
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) {
+	p.Lock()
+	for i, pe := range p.peers {
+		if pe.ID() == ep.ID() {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			p.ring = newRing(p.peers)
+			break
+		}
+	}
+	p.Unlock()
+
+	// the PULL portal can no longer acknowledge the messages it received
+	p.redeliverAll(ep.ID())
+}
+
+// SetStrategy sets the strategy by which messages are distributed across
+// connected PULL portals
+func (p *Protocol) SetStrategy(s Strategy) {
+	p.Lock()
+	p.strategy = s
+	p.Unlock()
+}
+
+// SetWeight sets the weight of a PULL portal under the Weighted strategy.  It
+// may be called before the PULL portal connects.  Weights default to 1.
+func (p *Protocol) SetWeight(id portal.ID, w int) {
+	p.Lock()
+	p.weights[id] = w
+	p.Unlock()
 }
 
-func (p Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
+// Portal is a PUSH portal
+type Portal interface {
+	portal.WriteOnly
+
+	// SendKey sends a value with a routing key.  Under the KeyAffinity
+	// strategy, values with the same key are delivered to the same PULL
+	// portal.
+	SendKey(c context.Context, key string, v interface{}) error
+
+	// SetStrategy sets the strategy by which messages are distributed across
+	// connected PULL portals.  It defaults to RoundRobin.
+	SetStrategy(Strategy)
+
+	// SetWeight sets the weight of a PULL portal under the Weighted strategy.
+	// Weights default to 1; weights lower than 1 restore the default.
+	SetWeight(portal.ID, int)
+
+	// SetAckPolicy sets the policy governing the acknowledgement and
+	// redelivery of messages.  Acknowledgements are disabled by default.  It
+	// returns an error if the dead-letter address cannot be connected to.
+	SetAckPolicy(AckPolicy) error
+}
+
+type pushPortal struct {
+	portal.WriteOnly
+	proto *Protocol
+}
+
+func (p pushPortal) SendKey(c context.Context, key string, v interface{}) error {
+	return p.SendEnvelope(c, portal.Envelope{
+		Header: map[string]string{proto.HdrKey: key},
+		Value:  v,
+	})
+}
+
+func (p pushPortal) SetStrategy(s Strategy)        { p.proto.SetStrategy(s) }
+func (p pushPortal) SetWeight(id portal.ID, w int) { p.proto.SetWeight(id, w) }
+
+func (p pushPortal) SetAckPolicy(ap AckPolicy) error { return p.proto.SetAckPolicy(ap) }
 
 // New allocates a WriteOnly Portal using the PUSH protocol
-func New(cfg portal.Cfg) portal.WriteOnly {
-	return struct{ portal.WriteOnly }{portal.MakePortal(cfg, &Protocol{})} // write guard
+func New(cfg portal.Cfg) Portal {
+	p := &Protocol{}
+	return pushPortal{WriteOnly: portal.MakePortal(cfg, p), proto: p} // write guard
+}
+
+// NewOf allocates a type-safe WriteOnly Portal using the PUSH protocol
+func NewOf[T any](cfg portal.Cfg) portal.TypedWriteOnly[T] {
+	return portal.TypedWriteOnly[T]{WriteOnly: New(cfg)}
 }
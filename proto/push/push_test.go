@@ -1,12 +1,15 @@
 package push
 
 import (
+	"context"
+	"strconv"
 	"testing"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 
 	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
 	"github.com/lthibault/portal/proto/pull"
 )
 
@@ -76,3 +79,249 @@ func TestIntegration(t *testing.T) {
 	}
 
 }
+
+// counts waits for n messages to be queued across the PULL portals, and
+// returns the number queued by each
+func counts(t *testing.T, ptls []portal.ReadOnly, n int) []int {
+	deadline := time.Now().Add(time.Second)
+	for {
+		cs := make([]int, len(ptls))
+		var total int
+		for i, p := range ptls {
+			_, cs[i] = p.Len()
+			total += cs[i]
+		}
+
+		if total >= n || time.Now().After(deadline) {
+			return cs
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func pulls(t *testing.T, addr string, n int) []portal.ReadOnly {
+	ptls := make([]portal.ReadOnly, n)
+	for i := range ptls {
+		ptls[i] = pull.New(portal.Cfg{Size: iter})
+		if err := ptls[i].Connect(addr); err != nil {
+			t.Error(err)
+		}
+	}
+	return ptls
+}
+
+func TestStrategy(t *testing.T) {
+	t.Run("RoundRobin", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		if err := p.Bind("/test/push/roundrobin"); err != nil {
+			t.Error(err)
+		}
+		ptls := pulls(t, "/test/push/roundrobin", 4)
+
+		for i := 0; i < 400; i++ {
+			p.Send(i)
+		}
+
+		for i, n := range counts(t, ptls, 400) {
+			if n != 100 {
+				t.Errorf("pull %d: expected 100 messages, got %d", i, n)
+			}
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		p := New(portal.Cfg{Size: 8})
+		p.SetStrategy(Weighted)
+		if err := p.Bind("/test/push/weighted"); err != nil {
+			t.Error(err)
+		}
+		ptls := pulls(t, "/test/push/weighted", 2)
+		p.SetWeight(ptls[0].ID(), 3)
+
+		for i := 0; i < 400; i++ {
+			p.Send(i)
+		}
+
+		if cs := counts(t, ptls, 400); cs[0] != 300 || cs[1] != 100 {
+			t.Errorf("expected [300 100], got %v", cs)
+		}
+	})
+
+	t.Run("LeastLoaded", func(t *testing.T) {
+		const nStuck, nMsg = 8, 100
+
+		p := New(portal.Cfg{Size: 4})
+		p.SetStrategy(LeastLoaded)
+		if err := p.Bind("/test/push/leastloaded"); err != nil {
+			t.Error(err)
+		}
+		pp := p.(pushPortal).proto
+
+		// The stuck portal never receives.  Fill it up:  its intake holds
+		// three messages, one is in flight and four are queued.
+		stuck := pull.New(portal.Cfg{})
+		if err := stuck.Connect("/test/push/leastloaded"); err != nil {
+			t.Error(err)
+		}
+
+		for i := 0; i < nStuck; i++ {
+			p.Send(i)
+		}
+
+		load := func() int {
+			pp.Lock()
+			defer pp.Unlock()
+			return pp.peers[0].load()
+		}
+
+		for deadline := time.Now().Add(time.Second); load() != cap(pp.peers[0].q)+1; {
+			if time.Now().After(deadline) {
+				t.Fatalf("stuck portal did not fill up (load %d)", load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		busy := pull.New(portal.Cfg{})
+		if err := busy.Connect("/test/push/leastloaded"); err != nil {
+			t.Error(err)
+		}
+
+		go func() {
+			for i := nStuck; i < nStuck+nMsg; i++ {
+				p.Send(i)
+			}
+		}()
+
+		for i := nStuck; i < nStuck+nMsg; i++ {
+			if v, err := busy.RecvCtx(ctxTimeout(t)); err != nil {
+				t.Fatalf("message %d: %s", i, err)
+			} else if v != i {
+				t.Errorf("expected %d, got %v", i, v)
+			}
+		}
+
+		if l := load(); l != cap(pp.peers[0].q)+1 {
+			t.Errorf("stuck portal was sent more messages (load %d)", l)
+		}
+	})
+
+	t.Run("KeyAffinity", func(t *testing.T) {
+		const nKeys = 64
+
+		p := New(portal.Cfg{Size: 8})
+		p.SetStrategy(KeyAffinity)
+		if err := p.Bind("/test/push/affinity"); err != nil {
+			t.Error(err)
+		}
+		ptls := pulls(t, "/test/push/affinity", 4)
+
+		for round := 0; round < 4; round++ {
+			for k := 0; k < nKeys; k++ {
+				if err := p.SendKey(context.Background(), strconv.Itoa(k), k); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		counts(t, ptls, nKeys*4)
+
+		owner := make(map[string]int)
+		for i, ptl := range ptls {
+			for {
+				env, err := ptl.RecvEnvelope(ctxTimeout(t))
+				if err != nil {
+					break
+				}
+
+				key := env.Header[proto.HdrKey]
+				if o, ok := owner[key]; ok && o != i {
+					t.Errorf("key %s delivered to pulls %d and %d", key, o, i)
+				}
+				owner[key] = i
+			}
+		}
+
+		if len(owner) != nKeys {
+			t.Errorf("expected %d keys, got %d", nKeys, len(owner))
+		}
+	})
+}
+
+type fakeEP struct {
+	portal.Endpoint
+	id portal.ID
+}
+
+func (ep fakeEP) ID() portal.ID { return ep.id }
+
+func TestCloseWhileFull(t *testing.T) {
+	p := New(portal.Cfg{Size: 1})
+	if err := p.Bind("/test/push/close"); err != nil {
+		t.Error(err)
+	}
+
+	q := pull.New(portal.Cfg{Size: 1})
+	if err := q.Connect("/test/push/close"); err != nil {
+		t.Error(err)
+	}
+	defer q.Close()
+
+	pp := p.(pushPortal).proto
+	pp.Lock()
+	pe := pp.peers[0]
+	pp.Unlock()
+
+	// the PULL portal never receives, so its queue eventually fills up
+	deadline := time.Now().Add(time.Second)
+	for i := 0; len(pe.q) < cap(pe.q); i++ {
+		if time.Now().After(deadline) {
+			t.Fatal("queue did not fill up")
+		}
+		p.TrySend(i)
+		time.Sleep(time.Millisecond)
+	}
+
+	ch := make(chan bool)
+	go func() { ch <- pp.dispatch(portal.Cfg{}, portal.NewMsg(), pp.ptl.CloseChannel(), nil) }()
+
+	time.Sleep(time.Millisecond * 10)
+	p.Close()
+
+	select {
+	case ok := <-ch:
+		if ok {
+			t.Error("message dispatched after the PUSH portal was closed")
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Error("dispatch blocked after the PUSH portal was closed")
+	}
+}
+
+func TestRing(t *testing.T) {
+	peers := make([]*pushEP, 4)
+	for i := range peers {
+		peers[i] = &pushEP{Endpoint: fakeEP{id: portal.NewID()}}
+	}
+
+	before, after := newRing(peers), newRing(peers[:3])
+
+	var moved int
+	for k := 0; k < 1000; k++ {
+		key := strconv.Itoa(k)
+		if o := before.lookup(key); o != peers[3] && o != after.lookup(key) {
+			t.Errorf("key %s remapped although its owner remained", key)
+		} else if o == peers[3] {
+			moved++
+		}
+	}
+
+	// the removed peer owns about a quarter of the keys
+	if moved < 150 || moved > 350 {
+		t.Errorf("unexpected share of keys owned by removed peer: %d/1000", moved)
+	}
+}
+
+func ctxTimeout(t *testing.T) context.Context {
+	c, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	t.Cleanup(cancel)
+	return c
+}
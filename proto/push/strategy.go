@@ -0,0 +1,181 @@
+package push
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+)
+
+// Strategy determines which PULL portal receives each message
+type Strategy uint8
+
+const (
+	// RoundRobin sends messages to each PULL portal in turn.  It is the
+	// default.
+	RoundRobin Strategy = iota
+
+	// LeastLoaded sends each message to the PULL portal with the fewest
+	// messages waiting to be delivered
+	LeastLoaded
+
+	// Weighted distributes messages in proportion to the weight of each PULL
+	// portal (see SetWeight)
+	Weighted
+
+	// KeyAffinity sends messages with the same key (see SendKey) to the same
+	// PULL portal.  Keys are placed on a consistent-hash ring, so that a PULL
+	// portal connecting or disconnecting only remaps its share of the keys.
+	// Messages without a key are sent in round-robin order.
+	KeyAffinity
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case LeastLoaded:
+		return "least-loaded"
+	case Weighted:
+		return "weighted"
+	case KeyAffinity:
+		return "key-affinity"
+	default:
+		return "unknown"
+	}
+}
+
+// replicas is the number of points each PULL portal occupies on the
+// consistent-hash ring
+const replicas = 256
+
+// ring is a consistent-hash ring of PULL portals
+type ring struct {
+	hashes []uint64
+	owners []*pushEP
+}
+
+// hash places a string on the ring.  FNV alone mixes the similar strings used
+// for ring points poorly, so its output is passed through a finalizer (that of
+// MurmurHash3) in which every input bit affects every output bit.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func newRing(peers []*pushEP) (r ring) {
+	type point struct {
+		hash  uint64
+		owner *pushEP
+	}
+
+	points := make([]point, 0, len(peers)*replicas)
+	for _, pe := range peers {
+		id := pe.ID().String()
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{hash(id + "#" + strconv.Itoa(i)), pe})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r.hashes = make([]uint64, len(points))
+	r.owners = make([]*pushEP, len(points))
+	for i, pt := range points {
+		r.hashes[i], r.owners[i] = pt.hash, pt.owner
+	}
+
+	return
+}
+
+// lookup returns the PULL portal owning the key
+func (r ring) lookup(key string) *pushEP {
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// pick the PULL portal to which msg is sent.  It returns nil if no PULL portal
+// is connected.  The caller must hold the lock.
+func (p *Protocol) pick(msg *portal.Message) *pushEP {
+	if len(p.peers) == 0 {
+		return nil
+	}
+
+	switch p.strategy {
+	case LeastLoaded:
+		return p.leastLoaded()
+	case Weighted:
+		return p.weighted()
+	case KeyAffinity:
+		if key, ok := msg.Header[proto.HdrKey]; ok {
+			return p.ring.lookup(key)
+		}
+	}
+
+	return p.roundRobin()
+}
+
+func (p *Protocol) roundRobin() *pushEP {
+	p.next = (p.next + 1) % len(p.peers)
+	return p.peers[p.next]
+}
+
+// leastLoaded breaks ties in round-robin order, so that idle PULL portals
+// share the load
+func (p *Protocol) leastLoaded() *pushEP {
+	best, load := -1, 0
+	for i := 1; i <= len(p.peers); i++ {
+		j := (p.next + i) % len(p.peers)
+		if l := p.peers[j].load(); best < 0 || l < load {
+			best, load = j, l
+		}
+	}
+
+	p.next = best
+	return p.peers[best]
+}
+
+// weighted implements smooth weighted round-robin, which interleaves PULL
+// portals rather than sending them bursts of messages
+func (p *Protocol) weighted() (best *pushEP) {
+	var total int
+	for _, pe := range p.peers {
+		w := p.weight(pe.ID())
+		pe.current += w
+		total += w
+
+		if best == nil || pe.current > best.current {
+			best = pe
+		}
+	}
+
+	best.current -= total
+	return
+}
+
+// weight of a PULL portal.  The caller must hold the lock.
+func (p *Protocol) weight(id portal.ID) int {
+	if w := p.weights[id]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// load is the number of messages waiting to be delivered to the PULL portal
+func (pe *pushEP) load() int {
+	return len(pe.q) + int(atomic.LoadInt32(&pe.inflight))
+}
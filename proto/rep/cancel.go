@@ -0,0 +1,108 @@
+package rep
+
+import (
+	"context"
+
+	"github.com/lthibault/portal"
+)
+
+// expired is the context of a request that is no longer awaiting a reply
+var expired = func() context.Context {
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	return c
+}()
+
+// watch tracks the cancellation of a request
+type watch struct {
+	context.Context
+	cancel context.CancelFunc
+
+	from     portal.ID
+	received bool // the application received the request
+}
+
+// watch a request as it arrives.  Resent requests share the existing watch.
+func (p *Protocol) watch(msg *portal.Message) {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.watches[msg.ID]; !ok {
+		p.watches[msg.ID] = newWatch(*msg.From)
+	}
+}
+
+func newWatch(from portal.ID) *watch {
+	c, cancel := context.WithCancel(context.Background())
+	return &watch{Context: c, cancel: cancel, from: from}
+}
+
+// received marks a request as received by the application.  It returns false
+// if the request was abandoned while it was queued, in which case it is
+// released.
+func (p *Protocol) received(msg *portal.Message) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	w, ok := p.watches[msg.ID]
+	switch {
+	case !ok: // a resent request, the original of which was replied to
+		w = newWatch(*msg.From)
+		p.watches[msg.ID] = w
+	case w.Err() != nil:
+		delete(p.watches, msg.ID)
+		return false
+	}
+
+	w.received = true
+	return true
+}
+
+// context returns the context of a request
+func (p *Protocol) context(id uint64) context.Context {
+	p.Lock()
+	defer p.Unlock()
+
+	if w, ok := p.watches[id]; ok {
+		return w
+	}
+	return expired
+}
+
+// release a request once it has been replied to
+func (p *Protocol) release(id uint64) {
+	p.Lock()
+	w, ok := p.watches[id]
+	delete(p.watches, id)
+	p.Unlock()
+
+	if ok {
+		w.cancel()
+	}
+}
+
+// abandon cancels the context of a request.  Requests that the application has
+// not yet received remain watched, so that they can be dropped upon receipt.
+func (p *Protocol) abandon(id uint64) {
+	p.Lock()
+	w, ok := p.watches[id]
+	p.Unlock()
+
+	if ok {
+		w.cancel()
+	}
+}
+
+// abandonAll abandons the requests issued by a REQ portal, and stops watching
+// them, since that portal has disconnected
+func (p *Protocol) abandonAll(from portal.ID) {
+	p.Lock()
+	defer p.Unlock()
+
+	for id, w := range p.watches {
+		if w.from == from {
+			w.cancel()
+			delete(p.watches, id)
+		}
+	}
+}
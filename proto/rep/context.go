@@ -0,0 +1,181 @@
+package rep
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNoRequest is returned when replying through a Context that has no
+	// pending request
+	ErrNoRequest = errors.New("no pending request")
+
+	// ErrNotStreaming is returned when opening a Stream for a request that was
+	// not sent with req.Portal.Stream
+	ErrNotStreaming = errors.New("request does not accept a stream of replies")
+)
+
+// Context is an independent handle on a REP portal.  Each call to Recv returns
+// a request, to which the next call to Send replies.  A Context must be used
+// from a single goroutine, but any number of contexts may serve requests
+// concurrently.
+type Context interface {
+	Recv() interface{}
+	RecvErr() (interface{}, error)
+	RecvCtx(context.Context) (interface{}, error)
+
+	// TryRecv receives a request without blocking.  It returns false if no
+	// request is queued.
+	TryRecv() (interface{}, bool)
+
+	Send(interface{})
+	SendErr(interface{}) error
+	SendCtx(context.Context, interface{}) error
+
+	// Fail replies to the pending request with an error, which
+	// req.Portal.Request returns as its error rather than as the reply.  It
+	// returns ErrNoRequest if no request is pending.
+	Fail(context.Context, error) error
+
+	// Context returns the context of the pending request.  It expires when
+	// the requester abandons the request, or once the request is replied to.
+	// It returns context.Background() if no request is pending.
+	Context() context.Context
+
+	// Stream replies to the pending request with a stream of replies.  It
+	// returns ErrNoRequest if no request is pending, and ErrNotStreaming if the
+	// request was not sent with req.Portal.Stream.
+	Stream() (Stream, error)
+}
+
+type repContext struct {
+	ptl   portal.Portal
+	proto *Protocol
+
+	sync.Mutex
+	pending *request
+}
+
+func (rc *repContext) Recv() (v interface{}) {
+	var err error
+	if v, err = rc.RecvErr(); err == portal.ErrNotConnected {
+		panic(err)
+	}
+	return
+}
+
+func (rc *repContext) RecvErr() (interface{}, error) { return rc.RecvCtx(context.Background()) }
+
+// RecvCtx receives a request.  Any request that was pending on the context is
+// abandoned; the REQ portal that issued it will eventually resend it.
+func (rc *repContext) RecvCtx(c context.Context) (interface{}, error) {
+	env, err := rc.ptl.RecvEnvelope(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.accept(env), nil
+}
+
+func (rc *repContext) TryRecv() (interface{}, bool) {
+	env, ok := rc.ptl.TryRecvEnvelope()
+	if !ok {
+		return nil, false
+	}
+
+	return rc.accept(env), true
+}
+
+// accept a request, abandoning any request that was pending on the context
+func (rc *repContext) accept(env portal.Envelope) interface{} {
+	_, stream := env.Header[proto.HdrStream]
+
+	rc.Lock()
+	prev := rc.pending
+	rc.pending = &request{from: env.From, id: env.ID, stream: stream}
+	rc.Unlock()
+
+	if prev != nil {
+		rc.proto.release(prev.id)
+	}
+
+	return env.Value
+}
+
+func (rc *repContext) Context() context.Context {
+	rc.Lock()
+	r := rc.pending
+	rc.Unlock()
+
+	if r == nil {
+		return context.Background()
+	}
+	return rc.proto.context(r.id)
+}
+
+// Send replies to the pending request.  The reply is dropped if no request is
+// pending.
+func (rc *repContext) Send(v interface{}) {
+	if err := rc.SendErr(v); err == portal.ErrNotConnected {
+		panic(err)
+	}
+}
+
+func (rc *repContext) SendErr(v interface{}) error { return rc.SendCtx(context.Background(), v) }
+
+// SendCtx replies to the pending request.  It returns ErrNoRequest if no
+// request is pending.
+func (rc *repContext) SendCtx(c context.Context, v interface{}) error {
+	return rc.reply(c, nil, v)
+}
+
+func (rc *repContext) Fail(c context.Context, err error) error {
+	return rc.reply(c, map[string]string{proto.HdrEOS: "true"}, err)
+}
+
+// reply to the pending request
+func (rc *repContext) reply(c context.Context, header map[string]string, v interface{}) error {
+	rc.Lock()
+	r := rc.pending
+	rc.pending = nil
+	rc.Unlock()
+
+	if r == nil {
+		return ErrNoRequest
+	}
+	defer rc.proto.release(r.id)
+
+	return rc.ptl.SendEnvelope(c, portal.Envelope{
+		To:      &r.from,
+		ReplyTo: r.id,
+		Header:  header,
+		Value:   v,
+	})
+}
+
+func (rc *repContext) Stream() (Stream, error) {
+	rc.Lock()
+	r := rc.pending
+	if r != nil && r.stream {
+		rc.pending = nil
+	}
+	rc.Unlock()
+
+	switch {
+	case r == nil:
+		return nil, ErrNoRequest
+	case !r.stream:
+		return nil, ErrNotStreaming
+	}
+
+	return &repStream{
+		ptl:    rc.ptl,
+		r:      r,
+		c:      rc.proto.context(r.id),
+		cancel: func() { rc.proto.release(r.id) },
+	}, nil
+}
@@ -7,60 +7,115 @@ import (
 	proto "github.com/lthibault/portal/proto"
 )
 
-const eqBufSize = 8
+// request identifies a request received from a REQ portal
+type request struct {
+	from   portal.ID
+	id     uint64
+	stream bool
+}
 
 // Protocol implementing REP
 type Protocol struct {
-	sync.Mutex
 	ptl portal.ProtocolPortal
 	n   proto.Neighborhood
+
+	sync.Mutex
+	pending *request          // request awaiting a reply, if any
+	watches map[uint64]*watch // contexts of requests awaiting a reply
 }
 
 func (p *Protocol) Init(ptl portal.ProtocolPortal) {
 	p.ptl = ptl
 	p.n = proto.NewNeighborhood()
+	p.watches = make(map[uint64]*watch)
+	go p.startSending()
 }
 
-func (p *Protocol) startServing(pe proto.PeerEndpoint) {
-	var msg *portal.Message
-	defer func() {
-		if msg != nil {
-			msg.Free()
-		}
-		if r := recover(); r != nil {
-			msg.Free()
-			panic(r)
-		}
-	}()
+// Intake processes cancellations as soon as they are received, rather than
+// when the application next calls Recv.  Requests that are cancelled before
+// the application receives them are dropped.
+func (p *Protocol) Intake(in <-chan *portal.Message) { go p.startReceiving(in) }
 
-	cq := p.ptl.CloseChannel()
-	rq := p.ptl.RecvChannel()
+// RecvHook records the request to which the next call to Send replies, and
+// drops requests that were abandoned while they were queued
+func (p *Protocol) RecvHook(msg *portal.Message) bool {
+	if msg.From == nil || !p.received(msg) {
+		return false // cannot reply to an anonymous or abandoned request
+	}
+
+	_, stream := msg.Header[proto.HdrStream]
+
+	p.Lock()
+	p.pending = &request{from: *msg.From, id: msg.ID, stream: stream}
+	p.Unlock()
+	return true
+}
+
+// SendHook addresses the reply to the requester.  Replies sent when no request
+// is pending are dropped.  Replies sent through a Context are already
+// addressed, and do not affect the pending request.
+func (p *Protocol) SendHook(msg *portal.Message) bool {
+	if msg.To != nil && msg.ReplyTo != 0 {
+		return true
+	}
+
+	p.Lock()
+	r := p.pending
+	p.pending = nil
+	p.Unlock()
+
+	if r == nil {
+		return false
+	}
+	p.release(r.id)
+
+	msg.To = &r.from
+	msg.ReplyTo = r.id
+	return true
+}
+
+func (p *Protocol) startSending() {
 	sq := p.ptl.SendChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-sq:
+			if peer, ok := p.n.GetPeer(*msg.To); ok {
+				proto.Deliver(peer, msg, cq)
+			} else {
+				msg.Free() // requester went away; it will resend elsewhere
+			}
+		}
+	}
+}
 
-	for msg = pe.Announce(); msg != nil; msg = pe.Announce() {
-		p.Lock()
+func (p *Protocol) startReceiving(in <-chan *portal.Message) {
+	rq := p.ptl.RecvChannel()
+	cq := p.ptl.CloseChannel()
 
+	for {
 		select {
 		case <-cq:
-			p.Unlock()
 			return
-		case rq <- msg:
+		case msg := <-in:
+			if _, ok := msg.Header[proto.HdrCancel]; ok {
+				p.abandon(msg.ReplyTo)
+				msg.Free()
+				continue
+			}
+
+			if msg.From != nil {
+				p.watch(msg)
+			}
+
 			select {
+			case rq <- msg:
 			case <-cq:
-				p.Unlock()
-				return
-			case <-pe.Done():
 				msg.Free()
-				p.Unlock()
-				continue
-			case msg = <-sq:
-				if msg == nil {
-					sq = p.ptl.SendChannel()
-					p.Unlock()
-				} else {
-					pe.Notify(msg)
-					p.Unlock()
-				}
+				return
 			}
 		}
 	}
@@ -73,16 +128,41 @@ func (*Protocol) PeerName() string   { return "req" }
 
 func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
 	proto.MustBeCompatible(p, ep.Signature())
+	p.n.SetPeer(ep.ID(), ep)
+}
 
-	pe := proto.NewPeerEP(ep)
-	p.n.SetPeer(ep.ID(), pe)
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) {
+	p.n.DropPeer(ep.ID())
+	p.abandonAll(ep.ID()) // the requester can no longer receive replies
+}
+
+// Portal is a REP portal.  Each call to Recv returns a request, to which the
+// next call to Send replies.  The reply is routed to the REQ portal that issued
+// the request.
+//
+// Recv and Send must therefore be called from a single goroutine.  To serve
+// requests concurrently, open a Context per goroutine instead.  Contexts and
+// the portal's own Recv/Send should not be mixed.
+type Portal interface {
+	portal.Portal
 
-	go p.startServing(pe)
+	// OpenContext returns a handle that receives requests and replies to them
+	// independently of other contexts on the same portal.
+	OpenContext() Context
 }
 
-func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
+type repPortal struct {
+	portal.Portal
+	proto *Protocol
+}
+
+func (r repPortal) OpenContext() Context { return &repContext{ptl: r.Portal, proto: r.proto} }
 
 // New allocates a new REP portal
-func New(cfg portal.Cfg) portal.Portal {
-	return portal.MakePortal(cfg, &Protocol{})
+func New(cfg portal.Cfg) Portal {
+	p := &Protocol{}
+	return repPortal{Portal: portal.MakePortal(cfg, p), proto: p}
 }
+
+// NewOf allocates a type-safe REP portal
+func NewOf[T any](cfg portal.Cfg) portal.Typed[T] { return portal.Typed[T]{Portal: New(cfg)} }
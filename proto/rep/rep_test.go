@@ -0,0 +1,238 @@
+package rep
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/req"
+	"github.com/pkg/errors"
+)
+
+func TestContext(t *testing.T) {
+	const (
+		nCtx  = 4
+		nReq  = 16
+		delay = time.Millisecond * 20
+	)
+
+	r := req.New(portal.Cfg{})
+	if err := r.Bind("/test/rep/context"); err != nil {
+		t.Error(err)
+	}
+
+	p := New(portal.Cfg{})
+	if err := p.Connect("/test/rep/context"); err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < nCtx; i++ {
+		go func(rc Context) {
+			for {
+				v, err := rc.RecvErr()
+				if err != nil {
+					return
+				}
+
+				time.Sleep(delay) // slow handler
+				rc.Send(v.(int) * 2)
+			}
+		}(p.OpenContext())
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(nReq)
+	for i := 0; i < nReq; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			if v, err := r.Request(c, i); err != nil {
+				t.Errorf("request %d: %s", i, err)
+			} else if v.(int) != i*2 {
+				t.Errorf("unexpected reply (expected %d, got %v)", i*2, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if d := time.Since(start); d >= delay*nReq/2 {
+		t.Errorf("requests were not served concurrently (took %s)", d)
+	}
+
+	t.Run("NoRequest", func(t *testing.T) {
+		if err := p.OpenContext().SendErr(true); err != ErrNoRequest {
+			t.Errorf("expected %s, got %v", ErrNoRequest, err)
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	r := req.New(portal.Cfg{})
+	if err := r.Bind("/test/rep/stream"); err != nil {
+		t.Error(err)
+	}
+
+	p := New(portal.Cfg{})
+	if err := p.Connect("/test/rep/stream"); err != nil {
+		t.Error(err)
+	}
+
+	rc := p.OpenContext()
+	errStream := errors.New("stream error")
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	t.Run("NotStreaming", func(t *testing.T) {
+		go r.Send(true)
+
+		rc.Recv()
+		if _, err := rc.Stream(); err != ErrNotStreaming {
+			t.Errorf("expected %s, got %v", ErrNotStreaming, err)
+		}
+		go rc.Send(true)
+		r.Recv()
+	})
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"EOF", nil},
+		{"Error", errStream},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			go func() {
+				n := rc.Recv().(int)
+				s, err := rc.Stream()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				for i := 0; i < n; i++ {
+					if err := s.Send(c, i); err != nil {
+						t.Error(err)
+					}
+				}
+				s.Close(tc.err)
+			}()
+
+			s := r.Stream(c, 3)
+			defer s.Close()
+
+			for i := 0; i < 3; i++ {
+				if v, err := s.Next(); err != nil {
+					t.Error(err)
+				} else if v.(int) != i {
+					t.Errorf("unexpected reply (expected %d, got %v)", i, v)
+				}
+			}
+
+			expected := tc.err
+			if expected == nil {
+				expected = io.EOF
+			}
+			if _, err := s.Next(); err != expected {
+				t.Errorf("expected %s, got %v", expected, err)
+			}
+		})
+	}
+
+	t.Run("Cancel", func(t *testing.T) {
+		done := make(chan error)
+		go func() {
+			rc.Recv()
+			s, err := rc.Stream()
+			if err != nil {
+				done <- err
+				return
+			}
+
+			for i := 0; ; i++ {
+				if err = s.Send(c, i); err != nil {
+					break
+				}
+			}
+
+			select {
+			case <-s.Context().Done():
+			default:
+				t.Error("stream context did not expire")
+			}
+			done <- err
+		}()
+
+		s := r.Stream(c, nil)
+		s.Next()
+		s.Next()
+		s.Close()
+
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("expected %s, got %v", context.Canceled, err)
+			}
+		case <-time.After(time.Millisecond * 100):
+			t.Error("responder was not informed of cancellation")
+		}
+	})
+}
+
+func TestAbandon(t *testing.T) {
+	r := req.New(portal.Cfg{})
+	if err := r.Bind("/test/rep/abandon"); err != nil {
+		t.Error(err)
+	}
+
+	p := New(portal.Cfg{Size: 1})
+	if err := p.Connect("/test/rep/abandon"); err != nil {
+		t.Error(err)
+	}
+
+	rc := p.OpenContext()
+
+	t.Run("Queued", func(t *testing.T) {
+		c, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+
+		if _, err := r.Request(c, 1); err != context.DeadlineExceeded {
+			t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+		}
+
+		time.Sleep(time.Millisecond) // cancellation is delivered asynchronously
+
+		// the abandoned request MUST be dropped
+		go r.Request(context.Background(), 2)
+		if v := rc.Recv(); v.(int) != 2 {
+			t.Errorf("received abandoned request %v", v)
+		}
+		rc.Send(nil)
+	})
+
+	t.Run("Received", func(t *testing.T) {
+		c, cancel := context.WithCancel(context.Background())
+		go r.Request(c, true)
+
+		rc.Recv()
+		if err := rc.Context().Err(); err != nil {
+			t.Errorf("request context expired prematurely: %s", err)
+		}
+
+		cancel()
+
+		select {
+		case <-rc.Context().Done():
+		case <-time.After(time.Millisecond * 100):
+			t.Error("request context was not cancelled")
+		}
+	})
+}
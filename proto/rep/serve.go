@@ -0,0 +1,131 @@
+package rep
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/lthibault/portal"
+)
+
+// DefaultWorkers is the number of requests a Server handles concurrently when
+// Server.Workers is not set
+const DefaultWorkers = 8
+
+// Handler responds to a request.  The value it returns is sent to the
+// requester as the reply.
+type Handler interface {
+	ServeRequest(context.Context, interface{}) interface{}
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(context.Context, interface{}) interface{}
+
+// ServeRequest calls f(c, v)
+func (f HandlerFunc) ServeRequest(c context.Context, v interface{}) interface{} { return f(c, v) }
+
+// PanicError fails a request whose handler panicked.  req.Portal.Request
+// returns it as its error.
+type PanicError struct {
+	Value interface{} // value passed to panic
+	Stack []byte      // stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("handler panic: %v", e.Value) }
+
+// Server serves requests received on a REP portal with a pool of workers
+type Server struct {
+	// Cfg configures the underlying REP portal
+	Cfg portal.Cfg
+
+	// Handler is invoked for each request
+	Handler Handler
+
+	// Workers is the number of requests handled concurrently.  It defaults to
+	// DefaultWorkers.
+	Workers int
+}
+
+// Serve binds a REP portal to addr, and serves requests until the context
+// expires.  Requests that are being handled or queued when the context expires
+// are allowed to complete, and their replies sent, before Serve closes the
+// portal and returns.  Handlers receive a context that carries the values of c.  It
+// is cancelled when the requester abandons the request, but not when c is.
+func (s *Server) Serve(c context.Context, addr string) error {
+	p := New(s.Cfg)
+	if err := p.Bind(addr); err != nil {
+		return err
+	}
+	defer p.Close()
+
+	n := s.Workers
+	if n <= 0 {
+		n = DefaultWorkers
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(rc Context) {
+			defer wg.Done()
+			s.serve(c, rc)
+		}(p.OpenContext())
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func (s *Server) serve(c context.Context, rc Context) {
+	hc := context.WithoutCancel(c)
+
+	for {
+		v, err := rc.RecvCtx(c)
+		if err != nil {
+			break // shutting down
+		}
+		s.reply(hc, rc, v)
+	}
+
+	// drain the requests that were queued before shutdown
+	if c.Err() != nil {
+		for v, ok := rc.TryRecv(); ok; v, ok = rc.TryRecv() {
+			s.reply(hc, rc, v)
+		}
+	}
+}
+
+// reply to a request with the handler's response
+func (s *Server) reply(c context.Context, rc Context, v interface{}) {
+	// cancel the handler's context if the requester abandons the request
+	rctx, cancel := context.WithCancel(c)
+	stop := context.AfterFunc(rc.Context(), cancel)
+
+	rep, err := s.handle(rctx, v)
+	stop()
+	cancel()
+
+	if err != nil {
+		_ = rc.Fail(c, err)
+	} else {
+		_ = rc.SendCtx(c, rep)
+	}
+}
+
+// handle invokes the handler, converting a panic into a PanicError
+func (s *Server) handle(c context.Context, v interface{}) (rep interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	return s.Handler.ServeRequest(c, v), nil
+}
+
+// Serve binds a REP portal to addr, and serves requests with the handler until
+// the context expires.  See Server.Serve.
+func Serve(c context.Context, addr string, h Handler) error {
+	return (&Server{Handler: h}).Serve(c, addr)
+}
@@ -0,0 +1,186 @@
+package rep
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/req"
+	"github.com/pkg/errors"
+)
+
+// dial connects a REQ portal to an address that is being bound concurrently
+func dial(t *testing.T, addr string) req.Portal {
+	r := req.New(portal.Cfg{})
+	for err := r.Connect(addr); err != nil; err = r.Connect(addr) {
+		if errors.Cause(err) != portal.ErrUnboundAddr {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return r
+}
+
+func TestServe(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	h := HandlerFunc(func(_ context.Context, v interface{}) interface{} {
+		switch v := v.(int); {
+		case v < 0:
+			panic("negative")
+		case v == 0:
+			close(started)
+			time.Sleep(time.Millisecond * 20)
+		}
+		return v.(int) * 2
+	})
+
+	done := make(chan error)
+	go func() { done <- Serve(c, "/test/rep/serve", h) }()
+
+	r := dial(t, "/test/rep/serve")
+
+	rc, rcancel := context.WithTimeout(context.Background(), time.Second)
+	defer rcancel()
+
+	t.Run("Reply", func(t *testing.T) {
+		if v, err := r.Request(rc, 21); err != nil {
+			t.Error(err)
+		} else if v.(int) != 42 {
+			t.Errorf("unexpected reply (expected 42, got %v)", v)
+		}
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		if v, err := r.Request(rc, -1); v != nil {
+			t.Errorf("unexpected reply %v", v)
+		} else if _, ok := err.(*PanicError); !ok {
+			t.Errorf("expected *PanicError, got %v", err)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		ch := make(chan interface{})
+		go func() {
+			v, err := r.Request(rc, 0)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- v
+		}()
+
+		<-started
+		cancel()
+
+		if v := <-ch; v != 0 {
+			t.Errorf("unexpected reply to in-flight request (expected 0, got %v)", v)
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(time.Millisecond * 100):
+			t.Error("Serve did not return after shutdown")
+		}
+	})
+}
+
+func TestServeCancel(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cancelled := make(chan struct{})
+	h := HandlerFunc(func(c context.Context, _ interface{}) interface{} {
+		select {
+		case <-c.Done():
+			close(cancelled)
+		case <-time.After(time.Second):
+		}
+		return nil
+	})
+
+	go Serve(c, "/test/rep/serve/cancel", h)
+
+	r := dial(t, "/test/rep/serve/cancel")
+
+	rc, rcancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer rcancel()
+
+	if _, err := r.Request(rc, true); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Millisecond * 100):
+		t.Error("handler context was not cancelled")
+	}
+}
+
+func TestServeDrainQueue(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	h := HandlerFunc(func(_ context.Context, v interface{}) interface{} {
+		if v.(int) == 0 {
+			close(started)
+			<-release
+		}
+		return v
+	})
+
+	done := make(chan error)
+	s := &Server{Handler: h, Workers: 1}
+	go func() { done <- s.Serve(c, "/test/rep/serve/queue") }()
+
+	rc, rcancel := context.WithTimeout(context.Background(), time.Second)
+	defer rcancel()
+
+	ch := make(chan interface{}, 2)
+	request := func(r req.Portal, v int) {
+		rep, err := r.Request(rc, v)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- rep
+	}
+
+	go request(dial(t, "/test/rep/serve/queue"), 0)
+	<-started
+
+	// the only worker is busy, so this request remains queued
+	go request(dial(t, "/test/rep/serve/queue"), 1)
+	time.Sleep(time.Millisecond * 20)
+
+	cancel()
+	close(release)
+
+	replies := map[interface{}]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-ch:
+			replies[v] = true
+		case <-time.After(time.Millisecond * 100):
+			t.Fatal("queued request was not served after shutdown")
+		}
+	}
+
+	if !replies[0] || !replies[1] {
+		t.Errorf("unexpected replies %v", replies)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Error("Serve did not return after shutdown")
+	}
+}
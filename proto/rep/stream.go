@@ -0,0 +1,62 @@
+package rep
+
+import (
+	"context"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+)
+
+// Stream sends a sequence of replies to a streaming request
+type Stream interface {
+	// Context expires when the requester abandons the stream
+	Context() context.Context
+
+	// Send a reply.  It returns the stream context's error if the requester
+	// abandoned the stream.
+	Send(context.Context, interface{}) error
+
+	// Close ends the stream.  The requester receives err, or io.EOF if err is
+	// nil, once it has consumed the preceding replies.
+	Close(err error) error
+}
+
+type repStream struct {
+	ptl    portal.Portal
+	r      *request
+	c      context.Context
+	cancel context.CancelFunc
+}
+
+func (s *repStream) Context() context.Context { return s.c }
+
+func (s *repStream) Send(c context.Context, v interface{}) error {
+	if err := s.c.Err(); err != nil {
+		return err
+	}
+
+	c, cancel := context.WithCancel(c)
+	defer cancel()
+	defer context.AfterFunc(s.c, cancel)()
+
+	return s.ptl.SendEnvelope(c, portal.Envelope{
+		To:      &s.r.from,
+		ReplyTo: s.r.id,
+		Value:   v,
+	})
+}
+
+func (s *repStream) Close(err error) error {
+	defer s.cancel()
+
+	if err := s.c.Err(); err != nil {
+		return err
+	}
+
+	return s.ptl.SendEnvelope(s.c, portal.Envelope{
+		To:      &s.r.from,
+		ReplyTo: s.r.id,
+		Header:  map[string]string{proto.HdrEOS: "true"},
+		Value:   err,
+	})
+}
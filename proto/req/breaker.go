@@ -0,0 +1,223 @@
+package req
+
+import (
+	"time"
+
+	"github.com/lthibault/portal"
+)
+
+// DefaultCooldown is the default duration during which no request is routed to
+// a REP portal whose circuit is open
+const DefaultCooldown = time.Second * 5
+
+// BreakerState is the state of the circuit to a REP portal
+type BreakerState uint8
+
+const (
+	// BreakerClosed circuits route requests normally
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen circuits route no requests until the cooldown has elapsed
+	BreakerOpen
+
+	// BreakerHalfOpen circuits route a single probe request.  The circuit is
+	// closed if it succeeds, and opened again if it fails.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerEvent reports a change in the state of the circuit to a REP portal
+type BreakerEvent struct {
+	Peer     portal.ID
+	From, To BreakerState
+}
+
+// BreakerPolicy governs per-peer circuit breaking.  A failure is a request
+// that times out (see RetryPolicy.Backoff), or an error reply deemed
+// retryable by the retry policy.  Any other reply is a success.  The zero
+// value disables circuit breaking.
+type BreakerPolicy struct {
+	// Failures is the number of consecutive failures that open the circuit
+	Failures int
+
+	// Cooldown is the duration after which an open circuit becomes
+	// half-open.  It defaults to DefaultCooldown.
+	Cooldown time.Duration
+
+	// OnStateChange, if non-nil, is called whenever a circuit changes state.
+	// It MUST NOT block.
+	OnStateChange func(BreakerEvent)
+}
+
+func (bp BreakerPolicy) enabled() bool { return bp.Failures > 0 }
+
+func (bp BreakerPolicy) cooldown() time.Duration {
+	if bp.Cooldown > 0 {
+		return bp.Cooldown
+	}
+	return DefaultCooldown
+}
+
+// breaker tracks the health of a REP portal
+type breaker struct {
+	state    BreakerState
+	failures int
+	probe    *request // outstanding probe request (half-open only)
+	timer    *time.Timer
+}
+
+// available reports whether a request may be routed to a REP portal, and
+// claims the probe for r if the circuit is half-open.  The caller must hold the
+// lock.
+func (p *Protocol) available(id portal.ID, r *request) bool {
+	b, ok := p.breakers[id]
+	if !ok || !p.breaking.enabled() {
+		return true
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.probe == nil {
+			b.probe = r
+			return true
+		}
+	}
+
+	return false
+}
+
+// transition changes the state of a circuit.  The caller must hold the lock,
+// and emit the returned event once it has released the lock.
+func (p *Protocol) transition(id portal.ID, b *breaker, to BreakerState) (ev *BreakerEvent) {
+	if b.state != to {
+		ev = &BreakerEvent{Peer: id, From: b.state, To: to}
+	}
+
+	b.state = to
+	b.probe = nil
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+
+	if to == BreakerOpen {
+		b.timer = time.AfterFunc(p.breaking.cooldown(), func() { p.halfOpen(id) })
+	}
+
+	return
+}
+
+// failure records a failure of a REP portal.  The caller must hold the lock,
+// and emit the returned event once it has released the lock.
+func (p *Protocol) failure(id *portal.ID) *BreakerEvent {
+	if id == nil || !p.breaking.enabled() {
+		return nil
+	}
+
+	b, ok := p.breakers[*id]
+	if !ok {
+		return nil
+	}
+
+	switch b.failures++; b.state {
+	case BreakerHalfOpen:
+		return p.transition(*id, b, BreakerOpen)
+	case BreakerClosed:
+		if b.failures >= p.breaking.Failures {
+			return p.transition(*id, b, BreakerOpen)
+		}
+	}
+
+	return nil
+}
+
+// success records a success of a REP portal.  The caller must hold the lock,
+// and emit the returned event once it has released the lock.
+func (p *Protocol) success(id *portal.ID) *BreakerEvent {
+	if id == nil {
+		return nil
+	}
+
+	b, ok := p.breakers[*id]
+	if !ok {
+		return nil
+	}
+
+	b.failures = 0
+	if b.state == BreakerHalfOpen {
+		return p.transition(*id, b, BreakerClosed)
+	}
+
+	return nil
+}
+
+// releaseProbes releases the probes claimed by a request that completed
+// without a reply from the probed REP portal (e.g. because it was abandoned),
+// so that another request may probe the circuit.  The caller must hold the
+// lock.
+func (p *Protocol) releaseProbes(r *request) {
+	for _, id := range r.sent {
+		if b, ok := p.breakers[id]; ok && b.probe == r {
+			b.probe = nil
+		}
+	}
+}
+
+// halfOpen lets a probe request through an open circuit once the cooldown has
+// elapsed
+func (p *Protocol) halfOpen(id portal.ID) {
+	p.Lock()
+	var ev *BreakerEvent
+	if b, ok := p.breakers[id]; ok && b.state == BreakerOpen {
+		ev = p.transition(id, b, BreakerHalfOpen)
+	}
+	p.Unlock()
+
+	p.emit(ev)
+
+	// send requests that were held back while all circuits were open
+	p.retryAll(func(r *request) bool { return r.peer == nil })
+}
+
+// emit a breaker event
+func (p *Protocol) emit(ev *BreakerEvent) {
+	p.Lock()
+	hook := p.breaking.OnStateChange
+	p.Unlock()
+
+	if ev != nil && hook != nil {
+		hook(*ev)
+	}
+}
+
+// SetBreakerPolicy sets the policy governing per-peer circuit breaking
+func (p *Protocol) SetBreakerPolicy(bp BreakerPolicy) {
+	p.Lock()
+	p.breaking = bp
+	p.Unlock()
+}
+
+// PeerState returns the state of the circuit to a connected REP portal
+func (p *Protocol) PeerState(id portal.ID) BreakerState {
+	p.Lock()
+	defer p.Unlock()
+
+	if b, ok := p.breakers[id]; ok && p.breaking.enabled() {
+		return b.state
+	}
+	return BreakerClosed
+}
@@ -0,0 +1,191 @@
+package req
+
+import (
+	"container/list"
+	"context"
+	"time"
+)
+
+// flight is a request shared by concurrent callers of RequestKey
+type flight struct {
+	done    chan struct{}
+	v       interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// requestKey is like request, but coalesces concurrent requests with the same
+// key, and caches their replies
+func (p *Protocol) requestKey(c context.Context, key string, v interface{}) (interface{}, error) {
+	p.Lock()
+
+	if v, ok := p.cache.get(key); ok {
+		p.Unlock()
+		return v, nil
+	}
+
+	f, ok := p.flights[key]
+	if !ok {
+		fc, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		p.flights[key] = f
+		go p.fly(fc, key, v, f)
+	}
+	f.waiters++
+
+	p.Unlock()
+
+	select {
+	case <-f.done:
+		return f.v, f.err
+	case <-c.Done():
+	}
+
+	p.Lock()
+	if f.waiters--; f.waiters == 0 {
+		p.land(key, f)
+		f.cancel() // abandon the request; nobody is waiting for it
+	}
+	p.Unlock()
+
+	return nil, c.Err()
+}
+
+// fly sends a shared request, and caches its reply
+func (p *Protocol) fly(c context.Context, key string, v interface{}, f *flight) {
+	defer f.cancel()
+
+	f.v, f.err = p.request(c, v)
+
+	p.Lock()
+	if p.land(key, f) && f.err == nil {
+		if _, failed := f.v.(error); !failed {
+			p.cache.put(key, f.v)
+		}
+	}
+	p.Unlock()
+
+	close(f.done)
+}
+
+// land removes a flight, unless it was already replaced.  It returns false if
+// the flight was abandoned.  The caller must hold the lock.
+func (p *Protocol) land(key string, f *flight) bool {
+	if p.flights[key] != f {
+		return false
+	}
+
+	delete(p.flights, key)
+	return true
+}
+
+// CachePolicy governs the caching of replies to requests sent with
+// RequestKey.  The zero value disables caching.
+type CachePolicy struct {
+	// TTL is the duration for which a reply is cached
+	TTL time.Duration
+
+	// MaxEntries bounds the number of cached replies.  The least recently used
+	// reply is evicted when the bound is exceeded.  Zero means no limit.
+	MaxEntries int
+}
+
+// CacheStats reports the activity of the reply cache
+type CacheStats struct {
+	Hits, Misses uint64
+	Evictions    uint64 // replies evicted to respect MaxEntries
+	Expirations  uint64 // replies discarded after their TTL
+	Len          int    // replies currently cached
+}
+
+type cacheEntry struct {
+	key     string
+	v       interface{}
+	expires time.Time
+}
+
+// replyCache is an LRU cache of replies with a TTL.  It is guarded by the
+// protocol's lock.
+type replyCache struct {
+	policy CachePolicy
+	lru    *list.List // front is most recently used
+	items  map[string]*list.Element
+	stats  CacheStats
+}
+
+func newReplyCache(cp CachePolicy) replyCache {
+	return replyCache{
+		policy: cp,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+func (rc *replyCache) get(key string) (interface{}, bool) {
+	if rc.policy.TTL <= 0 {
+		return nil, false
+	}
+
+	el, ok := rc.items[key]
+	if !ok {
+		rc.stats.Misses++
+		return nil, false
+	}
+
+	if e := el.Value.(*cacheEntry); time.Now().Before(e.expires) {
+		rc.lru.MoveToFront(el)
+		rc.stats.Hits++
+		return e.v, true
+	}
+
+	rc.remove(el)
+	rc.stats.Expirations++
+	rc.stats.Misses++
+	return nil, false
+}
+
+func (rc *replyCache) put(key string, v interface{}) {
+	if rc.policy.TTL <= 0 {
+		return
+	}
+
+	e := &cacheEntry{key: key, v: v, expires: time.Now().Add(rc.policy.TTL)}
+	if el, ok := rc.items[key]; ok {
+		el.Value = e
+		rc.lru.MoveToFront(el)
+		return
+	}
+
+	rc.items[key] = rc.lru.PushFront(e)
+
+	for rc.policy.MaxEntries > 0 && rc.lru.Len() > rc.policy.MaxEntries {
+		rc.remove(rc.lru.Back())
+		rc.stats.Evictions++
+	}
+}
+
+func (rc *replyCache) remove(el *list.Element) {
+	rc.lru.Remove(el)
+	delete(rc.items, el.Value.(*cacheEntry).key)
+}
+
+// SetCachePolicy sets the policy governing the caching of replies to requests
+// sent with RequestKey.  Previously cached replies are discarded.
+func (p *Protocol) SetCachePolicy(cp CachePolicy) {
+	p.Lock()
+	stats := p.cache.stats
+	p.cache = newReplyCache(cp)
+	p.cache.stats = stats
+	p.Unlock()
+}
+
+// CacheStats reports the activity of the reply cache
+func (p *Protocol) CacheStats() CacheStats {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := p.cache.stats
+	stats.Len = p.cache.lru.Len()
+	return stats
+}
@@ -0,0 +1,114 @@
+package req
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/rep"
+)
+
+// counter is a REP portal that counts the requests it serves
+func counter(t *testing.T, addr string, delay time.Duration) (Portal, *int32) {
+	r := New(portal.Cfg{})
+	if err := r.Bind(addr); err != nil {
+		t.Error(err)
+	}
+
+	p := rep.New(portal.Cfg{})
+	if err := p.Connect(addr); err != nil {
+		t.Error(err)
+	}
+
+	var n int32
+	go func() {
+		for {
+			v, err := p.RecvErr()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&n, 1)
+			time.Sleep(delay)
+			p.Send(v)
+		}
+	}()
+
+	return r, &n
+}
+
+func TestCoalesce(t *testing.T) {
+	const nCallers = 16
+
+	r, n := counter(t, "/test/req/coalesce", time.Millisecond*20)
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(nCallers)
+	for i := 0; i < nCallers; i++ {
+		go func() {
+			defer wg.Done()
+
+			if v, err := r.RequestKey(c, "key", true); err != nil {
+				t.Error(err)
+			} else if v != true {
+				t.Errorf("unexpected reply %v", v)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(n); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+
+	t.Run("Abandon", func(t *testing.T) {
+		ac, acancel := context.WithTimeout(context.Background(), time.Millisecond*5)
+		defer acancel()
+
+		if _, err := r.RequestKey(ac, "abandoned", true); err != context.DeadlineExceeded {
+			t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+		}
+
+		// the abandoned request MUST NOT be shared with subsequent callers
+		if v, err := r.RequestKey(c, "abandoned", 1); err != nil {
+			t.Error(err)
+		} else if v != 1 {
+			t.Errorf("unexpected reply %v", v)
+		}
+	})
+}
+
+func TestCache(t *testing.T) {
+	r, n := counter(t, "/test/req/cache", 0)
+	r.SetCachePolicy(CachePolicy{TTL: time.Millisecond * 50, MaxEntries: 2})
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, key := range []string{"a", "b", "c", "c", "b", "a"} {
+		if v, err := r.RequestKey(c, key, key); err != nil {
+			t.Error(err)
+		} else if v != key {
+			t.Errorf("unexpected reply (expected %s, got %v)", key, v)
+		}
+	}
+
+	if n := atomic.LoadInt32(n); n != 4 {
+		t.Errorf("expected 4 requests, got %d", n)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	r.RequestKey(c, "a", "a")
+
+	stats := r.CacheStats()
+	expected := CacheStats{Hits: 2, Misses: 5, Evictions: 2, Expirations: 1, Len: 2}
+	if stats != expected {
+		t.Errorf("unexpected stats (expected %+v, got %+v)", expected, stats)
+	}
+}
@@ -1,87 +1,654 @@
 package req
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/lthibault/portal"
 	proto "github.com/lthibault/portal/proto"
+	"github.com/pkg/errors"
 )
 
+// DefaultResendInterval is the default duration after which a request that
+// has not been replied to is sent again, possibly to a different REP portal
+const DefaultResendInterval = time.Minute
+
+// ErrMalformedReply is returned by Request when the REP portal fails the
+// request without an error
+var ErrMalformedReply = errors.New("malformed reply")
+
+// request is an outstanding request
+type request struct {
+	id     uint64
+	from   *portal.ID
+	header map[string]string
+	value  interface{}
+
+	peer    *portal.ID  // REP portal to which the request was last sent
+	sent    []portal.ID // REP portals to which the request was sent
+	attempt int         // number of times the request was sent, excluding hedges
+	first   time.Time   // time at which the request was first sent
+	timer   *time.Timer // resend timer
+	hedge   *time.Timer // hedging timer
+
+	reply chan *portal.Message // nil unless the request was issued by Request or Stream
+	done  <-chan struct{}      // closed when the requester abandons the request
+	relay *relay               // forwards the replies to a stream
+
+	stream  bool // multiple replies may be received
+	started bool // a partial reply was received; the request is no longer resent
+}
+
+// msg returns a copy of the request, suitable for resending
+func (r *request) msg() *portal.Message {
+	msg := portal.NewMsg()
+	msg.ID = r.id
+	msg.From = r.from
+	msg.Header = r.header
+	msg.Sent = time.Now()
+	msg.Value = r.value
+	return msg
+}
+
+// stop the request's timers.  The caller must hold the lock.
+func (r *request) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.hedge != nil {
+		r.hedge.Stop()
+	}
+}
+
 // Protocol implementing REQ
 type Protocol struct {
 	ptl portal.ProtocolPortal
-	n   proto.Neighborhood
+
+	sync.Mutex
+	peers   []portal.Endpoint
+	next    int
+	pending map[uint64]*request
+	policy  RetryPolicy
+	hedging HedgePolicy
+	latency latencies
+
+	breaking BreakerPolicy
+	breakers map[portal.ID]*breaker
+
+	flights map[string]*flight
+	cache   replyCache
 }
 
 func (p *Protocol) Init(ptl portal.ProtocolPortal) {
 	p.ptl = ptl
-	p.n = proto.NewNeighborhood()
+	p.pending = make(map[uint64]*request)
+	p.breakers = make(map[portal.ID]*breaker)
+	p.flights = make(map[string]*flight)
+	p.cache = newReplyCache(CachePolicy{})
+	go p.startSending()
 }
 
-func (p Protocol) startSending(pe proto.PeerEndpoint) {
+// Intake correlates replies with outstanding requests, and discards the
+// others (e.g. duplicate replies to a request that was resent)
+func (p *Protocol) Intake(in <-chan *portal.Message) { go p.startReceiving(in) }
 
-	// NB: Because this function is only called when an endpoint is
-	// added, we can reasonably safely cache the channels -- they won't
-	// be changing after this point.
+// SetResendInterval sets the duration after which a request that has not been
+// replied to is sent again.  It is a shorthand for setting the Backoff of the
+// retry policy.
+func (p *Protocol) SetResendInterval(d time.Duration) {
+	p.Lock()
+	p.policy.Backoff = d
+	p.Unlock()
+}
 
-	sq := p.ptl.SendChannel()
-	cq := p.ptl.CloseChannel()
+// register a request as outstanding
+func (p *Protocol) register(msg *portal.Message, reply chan *portal.Message, done <-chan struct{}) *request {
+	_, stream := msg.Header[proto.HdrStream]
+	r := &request{
+		id:     msg.ID,
+		from:   msg.From,
+		header: msg.Header,
+		value:  msg.Value,
+		reply:  reply,
+		done:   done,
+		stream: stream,
+	}
+	if stream {
+		r.relay = newRelay(p.ptl.Config(), proto.QueueSize(p.ptl))
+		r.reply = r.relay.q
+	}
 
-	var msg *portal.Message
-	for {
-		select {
-		case msg = <-sq:
-		case <-cq:
-			return
-		case <-pe.Done():
-			return
+	p.Lock()
+	p.pending[r.id] = r
+	p.Unlock()
+
+	return r
+}
+
+// complete removes a request from the set of outstanding requests.  It returns
+// nil if the request is not outstanding.
+func (p *Protocol) complete(id uint64) *request {
+	p.Lock()
+	defer p.Unlock()
+
+	r, ok := p.pending[id]
+	if !ok {
+		return nil
+	}
+
+	delete(p.pending, id)
+	r.stop()
+	p.releaseProbes(r)
+
+	return r
+}
+
+// replied returns the request to which msg replies, or nil if the request is
+// not outstanding or is to be sent again.  The request is completed unless msg
+// is a partial reply to a streaming request.
+func (p *Protocol) replied(msg *portal.Message) *request {
+	p.Lock()
+
+	r, ok := p.pending[msg.ReplyTo]
+	if !ok {
+		p.Unlock()
+		return nil
+	}
+
+	if !r.started && p.policy.retryable(msg.Value) {
+		ev := p.failure(msg.From)
+		if !p.policy.exhausted(r.attempt) {
+			r.stop()
+			r.timer = time.AfterFunc(p.policy.delay(r.attempt), func() { p.retry(r.id) })
+			p.Unlock()
+
+			p.emit(ev)
+			return nil
 		}
+		defer p.emit(ev)
+	} else if !r.started {
+		defer p.emit(p.success(msg.From))
+	}
+
+	r.stop()
+
+	if _, eos := msg.Header[proto.HdrEOS]; r.stream && !eos {
+		if !r.started {
+			r.started = true
+			r.peer = msg.From // the stream is pinned to the REP portal serving it
+			p.latency.add(time.Since(r.first))
+		}
+	} else {
+		delete(p.pending, r.id)
+		p.releaseProbes(r)
+		if !r.started {
+			p.latency.add(time.Since(r.first))
+		}
+	}
 
-		pe.Notify(msg)
+	// inform the other REP portals to which the request was sent
+	others := p.others(r, msg.From)
+	r.sent = r.sent[:0]
+	if msg.From != nil {
+		r.sent = append(r.sent, *msg.From)
 	}
+	p.Unlock()
+
+	p.notify(r, others)
+	return r
 }
 
-func (p Protocol) startReceiving(ep portal.Endpoint) {
-	var msg *portal.Message
-	defer func() {
-		if msg != nil {
-			msg.Free()
+// abandon a request, and inform the REP portals to which it was sent.  It
+// returns false if the request was already completed.
+func (p *Protocol) abandon(r *request) bool {
+	if p.complete(r.id) == nil {
+		return false // already replied to
+	}
+
+	p.Lock()
+	eps := p.others(r, nil)
+	p.Unlock()
+
+	p.notify(r, eps)
+	return true
+}
+
+// others returns the connected REP portals to which a request was sent, other
+// than the one with the given ID.  The caller must hold the lock.
+func (p *Protocol) others(r *request, except *portal.ID) (eps []portal.Endpoint) {
+	for i := range r.sent {
+		if except != nil && r.sent[i] == *except {
+			continue
+		}
+
+		if ep, ok := p.lookup(&r.sent[i]); ok {
+			eps = append(eps, ep)
 		}
-		if r := recover(); r != nil {
+	}
+	return
+}
+
+// notify REP portals that a request was abandoned
+func (p *Protocol) notify(r *request, eps []portal.Endpoint) {
+	from := p.ptl.ID()
+
+	for _, ep := range eps {
+		msg := portal.NewMsg()
+		msg.From = &from
+		msg.ReplyTo = r.id
+		msg.Header = map[string]string{proto.HdrCancel: "true"}
+		go proto.Deliver(ep, msg, p.ptl.CloseChannel())
+	}
+}
+
+// fail delivers an error to the requester in lieu of a reply.  The request
+// MUST have been completed.  Requests sent with Send are dropped.
+func (p *Protocol) fail(r *request, err error) {
+	if r.reply == nil {
+		return
+	}
+
+	msg := portal.NewMsg()
+	msg.ReplyTo = r.id
+	msg.Header = map[string]string{proto.HdrEOS: "true"}
+	msg.Value = err
+
+	if r.relay != nil {
+		r.relay.push(msg) // after the replies that were already received
+		return
+	}
+
+	go func() {
+		select {
+		case r.reply <- msg:
+		case <-r.done:
 			msg.Free()
-			panic(r)
 		}
 	}()
+}
+
+// lookup a connected REP portal.  The caller must hold the lock.
+func (p *Protocol) lookup(id *portal.ID) (portal.Endpoint, bool) {
+	if id != nil {
+		for _, ep := range p.peers {
+			if ep.ID() == *id {
+				return ep, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// route selects the REP portal to which a request is sent (round-robin,
+// skipping open circuits), and arms the request's resend and hedging timers.
+// It returns false if the request is no longer outstanding, or if no REP portal
+// is available.
+func (p *Protocol) route(r *request) (ep portal.Endpoint, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok = p.pending[r.id]; !ok {
+		return
+	}
+
+	if r.attempt++; r.attempt == 1 {
+		r.first = time.Now()
+	}
+
+	r.stop()
+	r.timer = time.AfterFunc(p.policy.delay(r.attempt), func() { p.timeout(r.id) })
+
+	ok = false
+	for i := range p.peers {
+		next := (p.next + 1 + i) % len(p.peers)
+		if p.available(p.peers[next].ID(), r) {
+			p.next, ep, ok = next, p.peers[next], true
+			break
+		}
+	}
+
+	if !ok {
+		r.peer = nil // resent as soon as a REP portal connects or a circuit half-opens
+		return
+	}
+
+	id := ep.ID()
+	r.peer = &id
+	r.sent = append(r.sent, id)
+
+	if d, hedge := p.hedgeDelay(); hedge {
+		r.hedge = time.AfterFunc(d, func() { p.hedgeRequest(r.id) })
+	}
+
+	return
+}
+
+// transmit sends a request to a REP portal.  It returns false if the message
+// was not delivered, in which case it is freed.
+func (p *Protocol) transmit(r *request, msg *portal.Message, done <-chan struct{}) bool {
+	ep, ok := p.route(r)
+	if !ok {
+		msg.Free()
+		return false
+	}
+
+	return p.deliver(ep, msg, done)
+}
+
+// deliver a request to a REP portal.  It returns false if the message was not
+// delivered, in which case it is freed.
+func (p *Protocol) deliver(ep portal.Endpoint, msg *portal.Message, done <-chan struct{}) bool {
+	select {
+	case ep.RecvChannel() <- msg:
+		return true
+	case <-ep.Done():
+	case <-p.ptl.CloseChannel():
+	case <-done:
+	}
+
+	msg.Free()
+	return false
+}
+
+// timeout records the failure of the REP portal to which an outstanding
+// request was sent, and resends the request
+func (p *Protocol) timeout(id uint64) {
+	var ev *BreakerEvent
+
+	p.Lock()
+	if r, ok := p.pending[id]; ok && !r.started {
+		ev = p.failure(r.peer)
+	}
+	p.Unlock()
+
+	p.emit(ev)
+	p.retry(id)
+}
+
+// retry resends an outstanding request, or fails it if the retry policy is
+// exhausted
+func (p *Protocol) retry(id uint64) {
+	p.Lock()
+	r, ok := p.pending[id]
+	ok = ok && !r.started
+	exhausted := ok && p.policy.exhausted(r.attempt)
+	p.Unlock()
+
+	switch {
+	case !ok:
+	case exhausted:
+		p.abandon(r)
+		p.fail(r, ErrMaxAttempts)
+	default:
+		p.transmit(r, r.msg(), nil)
+	}
+}
+
+// hedgeRequest sends a duplicate of an outstanding request to a REP portal to
+// which it was not yet sent
+func (p *Protocol) hedgeRequest(id uint64) {
+	p.Lock()
+	r, ok := p.pending[id]
+	if !ok || r.started {
+		p.Unlock()
+		return
+	}
+
+	var ep portal.Endpoint
+	for i := range p.peers {
+		candidate := p.peers[(p.next+1+i)%len(p.peers)]
+		if !r.sentTo(candidate.ID()) && p.available(candidate.ID(), r) {
+			ep = candidate
+			break
+		}
+	}
+
+	if ep != nil {
+		r.sent = append(r.sent, ep.ID())
+	}
+	p.Unlock()
+
+	if ep != nil {
+		p.deliver(ep, r.msg(), r.done)
+	}
+}
+
+// sentTo reports whether the request was sent to a REP portal.  The caller
+// must hold the lock.
+func (r *request) sentTo(id portal.ID) bool {
+	for _, s := range r.sent {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAll resends the outstanding requests matching the predicate
+func (p *Protocol) retryAll(match func(*request) bool) {
+	var ids []uint64
+
+	p.Lock()
+	for id, r := range p.pending {
+		if match(r) {
+			ids = append(ids, id)
+		}
+	}
+	p.Unlock()
 
+	for _, id := range ids {
+		go p.retry(id)
+	}
+}
+
+func (p *Protocol) startSending() {
+	sq := p.ptl.SendChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-sq:
+			p.transmit(p.register(msg, nil, nil), msg, nil)
+		}
+	}
+}
+
+func (p *Protocol) startReceiving(in <-chan *portal.Message) {
 	rq := p.ptl.RecvChannel()
 	cq := p.ptl.CloseChannel()
 
-	for msg = ep.Announce(); msg != nil; msg = ep.Announce() {
+	for {
 		select {
 		case <-cq:
-			break
-		case rq <- msg:
+			return
+		case msg := <-in:
+			r := p.replied(msg)
+			if r == nil {
+				msg.Free() // duplicate, unsolicited or retried reply
+				continue
+			}
+
+			switch {
+			case r.stream:
+				if !r.relay.push(msg) { // never waits for the stream's consumer
+					p.overflow(r)
+				}
+			case r.reply != nil:
+				r.reply <- msg // buffered
+			default:
+				select {
+				case rq <- msg:
+				case <-cq:
+					msg.Free()
+					return
+				}
+			}
 		}
 	}
 }
 
-func (Protocol) Number() uint16     { return proto.Req }
-func (Protocol) PeerNumber() uint16 { return proto.Rep }
-func (Protocol) Name() string       { return "req" }
-func (Protocol) PeerName() string   { return "rep" }
+// request sends a request and waits for the corresponding reply
+func (p *Protocol) request(c context.Context, v interface{}) (interface{}, error) {
+	from := p.ptl.ID()
+
+	msg := portal.NewMsg()
+	msg.From = &from
+	msg.Sent = time.Now()
+	msg.Value = v
+
+	r := p.register(msg, make(chan *portal.Message, 1), c.Done())
 
-func (p Protocol) AddEndpoint(ep portal.Endpoint) {
+	go p.transmit(r, msg, c.Done())
+
+	select {
+	case rep := <-r.reply:
+		v := rep.Value
+		_, failed := rep.Header[proto.HdrEOS]
+		rep.Free()
+
+		if failed {
+			if err, ok := v.(error); ok {
+				return nil, err
+			}
+			return nil, ErrMalformedReply
+		}
+		return v, nil
+	case <-c.Done():
+		p.abandon(r) // inform the REP portal
+		return nil, c.Err()
+	case <-p.ptl.CloseChannel():
+		p.complete(r.id)
+		return nil, portal.ErrClosed
+	}
+}
+
+func (*Protocol) Number() uint16     { return proto.Req }
+func (*Protocol) PeerNumber() uint16 { return proto.Rep }
+func (*Protocol) Name() string       { return "req" }
+func (*Protocol) PeerName() string   { return "rep" }
+
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
 	proto.MustBeCompatible(p, ep.Signature())
 
-	pe := proto.NewPeerEP(ep)
+	p.Lock()
+	p.peers = append(p.peers, ep)
+	p.breakers[ep.ID()] = &breaker{}
+	p.Unlock()
+
+	// send requests that were issued while no REP portal was connected
+	p.retryAll(func(r *request) bool { return r.peer == nil })
+}
 
-	p.n.SetPeer(ep.ID(), pe)
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) {
+	id := ep.ID()
 
-	go p.startSending(pe)
-	go p.startReceiving(ep)
+	p.Lock()
+	for i, peer := range p.peers {
+		if peer.ID() == id {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			break
+		}
+	}
+
+	if b, ok := p.breakers[id]; ok && b.timer != nil {
+		b.timer.Stop()
+	}
+	delete(p.breakers, id)
+	p.Unlock()
+
+	// requests sent to the departed REP portal will never be replied to
+	p.retryAll(func(r *request) bool { return r.peer != nil && *r.peer == id })
+	p.interrupt(id)
+}
+
+// Portal is a REQ portal.  Requests sent with Send are load-balanced across
+// connected REP portals, and their replies are returned by Recv.  Requests
+// that are not replied to in time are sent again, as per the retry policy.
+type Portal interface {
+	portal.Portal
+
+	// Request sends a request and waits for the corresponding reply.  It is
+	// safe to call Request concurrently; replies are correlated with their
+	// requests.  If the context expires first, the REP portal is informed that
+	// the request was abandoned (see rep.Context).  Request returns
+	// ErrMaxAttempts if the retry policy is exhausted.
+	Request(context.Context, interface{}) (interface{}, error)
+
+	// RequestKey is like Request, but concurrent calls with the same key share
+	// a single request and its reply.  The shared request is abandoned only if
+	// all callers give up on it.  Replies are cached as per the cache policy.
+	RequestKey(c context.Context, key string, v interface{}) (interface{}, error)
+
+	// Stream sends a request to which the REP portal may send any number of
+	// replies.  Cancelling the context, or closing the stream, abandons the
+	// request and informs the REP portal.  Each stream queues up to the
+	// portal's buffer size of replies until they are consumed, so that a slow
+	// consumer does not hold up other requests.  The Overflow policy applies
+	// to each stream separately, and Block abandons a stream whose queue is
+	// full with ErrStreamOverflow.
+	Stream(context.Context, interface{}) Stream
+
+	// SetResendInterval sets the duration after which a request that has not
+	// been replied to is sent again.  It defaults to DefaultResendInterval.
+	SetResendInterval(time.Duration)
+
+	// SetRetryPolicy sets the policy governing when outstanding requests are
+	// sent again.  It defaults to DefaultRetryPolicy.
+	SetRetryPolicy(RetryPolicy)
+
+	// SetHedgePolicy sets the policy governing when duplicates of outstanding
+	// requests are sent to a second REP portal.  Hedging is disabled by
+	// default.
+	SetHedgePolicy(HedgePolicy)
+
+	// SetBreakerPolicy sets the policy governing per-peer circuit breaking.
+	// Circuit breaking is disabled by default.
+	SetBreakerPolicy(BreakerPolicy)
+
+	// PeerState returns the state of the circuit to a connected REP portal
+	PeerState(portal.ID) BreakerState
+
+	// SetCachePolicy sets the policy governing the caching of replies to
+	// requests sent with RequestKey.  Caching is disabled by default.
+	SetCachePolicy(CachePolicy)
+
+	// CacheStats reports the activity of the reply cache
+	CacheStats() CacheStats
+}
+
+type reqPortal struct {
+	portal.Portal
+	proto *Protocol
 }
 
-func (p Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
+func (r reqPortal) Request(c context.Context, v interface{}) (interface{}, error) {
+	return r.proto.request(c, v)
+}
+
+func (r reqPortal) RequestKey(c context.Context, key string, v interface{}) (interface{}, error) {
+	return r.proto.requestKey(c, key, v)
+}
+
+func (r reqPortal) Stream(c context.Context, v interface{}) Stream { return r.proto.stream(c, v) }
+
+func (r reqPortal) SetResendInterval(d time.Duration) { r.proto.SetResendInterval(d) }
+func (r reqPortal) SetRetryPolicy(rp RetryPolicy)     { r.proto.SetRetryPolicy(rp) }
+func (r reqPortal) SetHedgePolicy(hp HedgePolicy)     { r.proto.SetHedgePolicy(hp) }
+func (r reqPortal) SetBreakerPolicy(bp BreakerPolicy) { r.proto.SetBreakerPolicy(bp) }
+func (r reqPortal) SetCachePolicy(cp CachePolicy)     { r.proto.SetCachePolicy(cp) }
+
+func (r reqPortal) PeerState(id portal.ID) BreakerState { return r.proto.PeerState(id) }
+func (r reqPortal) CacheStats() CacheStats              { return r.proto.CacheStats() }
 
 // New allocates a Portal using the REQ protocol
-func New(cfg portal.Cfg) portal.Portal {
-	return portal.MakePortal(cfg, &Protocol{})
+func New(cfg portal.Cfg) Portal {
+	p := &Protocol{policy: DefaultRetryPolicy}
+	return reqPortal{Portal: portal.MakePortal(cfg, p), proto: p}
 }
+
+// NewOf allocates a type-safe REQ portal.  Request remains available through
+// the untyped portal.
+func NewOf[T any](cfg portal.Cfg) portal.Typed[T] { return portal.Typed[T]{Portal: New(cfg)} }
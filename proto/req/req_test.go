@@ -0,0 +1,627 @@
+package req
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/lthibault/portal/proto/rep"
+	"github.com/pkg/errors"
+)
+
+func echo(p portal.Portal) {
+	for {
+		v, err := p.RecvErr()
+		if err != nil {
+			return
+		}
+		p.Send(v)
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	const nRep = 2
+
+	r := New(portal.Cfg{})
+	if err := r.Bind("/test/req/integration"); err != nil {
+		t.Error(err)
+	}
+
+	reps := make([]portal.Portal, nRep)
+	for i := range reps {
+		reps[i] = rep.New(portal.Cfg{})
+		if err := reps[i].Connect("/test/req/integration"); err != nil {
+			t.Error(err)
+		}
+		go echo(reps[i])
+	}
+
+	t.Run("SendRecv", func(t *testing.T) {
+		go r.Send(1)
+
+		if v := r.Recv(); v.(int) != 1 {
+			t.Errorf("unexpected reply (expected 1, got %v)", v)
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		const nReq = 64
+
+		c, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		wg.Add(nReq)
+		for i := 0; i < nReq; i++ {
+			go func(i int) {
+				defer wg.Done()
+
+				if v, err := r.Request(c, i); err != nil {
+					t.Errorf("request %d: %s", i, err)
+				} else if v.(int) != i {
+					t.Errorf("reply correlated with wrong request (expected %d, got %v)", i, v)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+func TestResend(t *testing.T) {
+	r := New(portal.Cfg{})
+	r.SetResendInterval(time.Millisecond * 10)
+
+	if err := r.Bind("/test/req/resend"); err != nil {
+		t.Error(err)
+	}
+
+	p := rep.New(portal.Cfg{})
+	if err := p.Connect("/test/req/resend"); err != nil {
+		t.Error(err)
+	}
+
+	go func() {
+		p.Recv() // drop the first request on the floor
+		echo(p)
+	}()
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if v, err := r.Request(c, true); err != nil {
+		t.Error(err)
+	} else if !v.(bool) {
+		t.Errorf("unexpected reply %v", v)
+	}
+}
+
+func TestRequestCancel(t *testing.T) {
+	r := New(portal.Cfg{})
+	if err := r.Bind("/test/req/cancel"); err != nil {
+		t.Error(err)
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	if _, err := r.Request(c, true); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestMalformedReply(t *testing.T) {
+	r := New(portal.Cfg{})
+	if err := r.Bind("/test/req/malformed"); err != nil {
+		t.Error(err)
+	}
+
+	p := rep.New(portal.Cfg{})
+	if err := p.Connect("/test/req/malformed"); err != nil {
+		t.Error(err)
+	}
+
+	go func() {
+		for _, v := range []interface{}{nil, "not an error"} {
+			env, err := p.RecvEnvelope(context.Background())
+			if err != nil {
+				return
+			}
+
+			// fail the request without an error
+			_ = p.SendEnvelope(context.Background(), portal.Envelope{
+				To:      &env.From,
+				ReplyTo: env.ID,
+				Header:  map[string]string{proto.HdrEOS: "true"},
+				Value:   v,
+			})
+		}
+	}()
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Request(c, i); err != ErrMalformedReply {
+			t.Errorf("request %d: expected %s, got %v", i, ErrMalformedReply, err)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Run("Delay", func(t *testing.T) {
+		rp := RetryPolicy{
+			Backoff:    time.Millisecond,
+			Multiplier: 2,
+			MaxBackoff: time.Millisecond * 5,
+		}
+
+		for i, expected := range []time.Duration{1, 2, 4, 5, 5} {
+			if d := rp.delay(i + 1); d != expected*time.Millisecond {
+				t.Errorf("attempt %d: expected %s, got %s", i+1, expected*time.Millisecond, d)
+			}
+		}
+
+		rp.Jitter = 0.5
+		for i := 1; i < 10; i++ {
+			if d := rp.delay(3); d > time.Millisecond*4 || d < time.Millisecond*2 {
+				t.Errorf("jittered delay %s out of bounds", d)
+			}
+		}
+	})
+
+	t.Run("MaxAttempts", func(t *testing.T) {
+		r := New(portal.Cfg{})
+		r.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond * 5})
+
+		if err := r.Bind("/test/req/retry/max"); err != nil {
+			t.Error(err)
+		}
+
+		p := rep.New(portal.Cfg{})
+		if err := p.Connect("/test/req/retry/max"); err != nil {
+			t.Error(err)
+		}
+
+		var n int32
+		go func() {
+			for {
+				if _, err := p.RecvErr(); err != nil {
+					return
+				}
+				atomic.AddInt32(&n, 1) // never reply
+			}
+		}()
+
+		c, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if _, err := r.Request(c, true); err != ErrMaxAttempts {
+			t.Errorf("expected %s, got %v", ErrMaxAttempts, err)
+		}
+
+		if n := atomic.LoadInt32(&n); n != 3 {
+			t.Errorf("expected 3 attempts, got %d", n)
+		}
+	})
+
+	t.Run("Retryable", func(t *testing.T) {
+		errTransient := errors.New("transient")
+
+		r := New(portal.Cfg{})
+		r.SetRetryPolicy(RetryPolicy{
+			Backoff:   time.Millisecond,
+			Retryable: func(err error) bool { return err == errTransient },
+		})
+
+		if err := r.Bind("/test/req/retry/retryable"); err != nil {
+			t.Error(err)
+		}
+
+		p := rep.New(portal.Cfg{})
+		if err := p.Connect("/test/req/retry/retryable"); err != nil {
+			t.Error(err)
+		}
+
+		go func() {
+			p.Recv()
+			p.Send(errTransient)
+			echo(p)
+		}()
+
+		c, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if v, err := r.Request(c, true); err != nil {
+			t.Error(err)
+		} else if v != true {
+			t.Errorf("unexpected reply %v", v)
+		}
+	})
+}
+
+func TestHedge(t *testing.T) {
+	const nReq = 8
+
+	r := New(portal.Cfg{})
+	r.SetHedgePolicy(HedgePolicy{Percentile: 0.9, Delay: time.Millisecond * 10})
+
+	if err := r.Bind("/test/req/hedge"); err != nil {
+		t.Error(err)
+	}
+
+	slow, fast := rep.New(portal.Cfg{}), rep.New(portal.Cfg{})
+	for _, p := range []portal.Portal{slow, fast} {
+		if err := p.Connect("/test/req/hedge"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 0; i < nReq; i++ {
+		go func(rc rep.Context) {
+			for {
+				v, err := rc.RecvErr()
+				if err != nil {
+					return
+				}
+
+				select {
+				case <-time.After(time.Second):
+				case <-rc.Context().Done():
+				}
+				rc.Send(v)
+			}
+		}(slow.OpenContext())
+	}
+	go echo(fast)
+
+	c, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(nReq)
+	for i := 0; i < nReq; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			if v, err := r.Request(c, i); err != nil {
+				t.Errorf("request %d: %s", i, err)
+			} else if v.(int) != i {
+				t.Errorf("unexpected reply (expected %d, got %v)", i, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBreaker(t *testing.T) {
+	r := New(portal.Cfg{})
+	r.SetResendInterval(time.Millisecond * 5)
+
+	events := make(chan BreakerEvent, 8)
+	r.SetBreakerPolicy(BreakerPolicy{
+		Failures:      2,
+		Cooldown:      time.Millisecond * 50,
+		OnStateChange: func(ev BreakerEvent) { events <- ev },
+	})
+
+	if err := r.Bind("/test/req/breaker"); err != nil {
+		t.Error(err)
+	}
+
+	wedged, healthy := rep.New(portal.Cfg{}), rep.New(portal.Cfg{})
+	for _, p := range []portal.Portal{wedged, healthy} {
+		if err := p.Connect("/test/req/breaker"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var n int32
+	go func() {
+		for {
+			if _, err := wedged.RecvErr(); err != nil {
+				return
+			}
+			atomic.AddInt32(&n, 1) // never reply
+		}
+	}()
+	go echo(healthy)
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	expect := func(to BreakerState) {
+		select {
+		case ev := <-events:
+			if ev.Peer != wedged.ID() {
+				t.Errorf("unexpected event for healthy peer: %v", ev)
+			} else if ev.To != to {
+				t.Errorf("expected transition to %s, got %s", to, ev.To)
+			}
+		case <-time.After(time.Millisecond * 200):
+			t.Errorf("no transition to %s", to)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := r.Request(c, i); err != nil {
+			t.Error(err)
+		}
+	}
+
+	expect(BreakerOpen)
+	if s := r.PeerState(wedged.ID()); s != BreakerOpen {
+		t.Errorf("expected %s, got %s", BreakerOpen, s)
+	}
+
+	// requests MUST NOT be routed to the open circuit
+	before := atomic.LoadInt32(&n)
+	for i := 0; i < 4; i++ {
+		if _, err := r.Request(c, i); err != nil {
+			t.Error(err)
+		}
+	}
+	if after := atomic.LoadInt32(&n); after != before {
+		t.Errorf("%d requests routed to open circuit", after-before)
+	}
+
+	expect(BreakerHalfOpen)
+
+	// the probe times out, and the circuit opens again
+	for i := 0; i < 2; i++ {
+		if _, err := r.Request(c, i); err != nil {
+			t.Error(err)
+		}
+	}
+	expect(BreakerOpen)
+}
+
+func TestBreakerProbeCancel(t *testing.T) {
+	r := New(portal.Cfg{})
+	r.SetResendInterval(time.Millisecond * 30)
+
+	events := make(chan BreakerEvent, 8)
+	r.SetBreakerPolicy(BreakerPolicy{
+		Failures:      1,
+		Cooldown:      time.Millisecond * 50,
+		OnStateChange: func(ev BreakerEvent) { events <- ev },
+	})
+
+	if err := r.Bind("/test/req/breaker/probe"); err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	p := rep.New(portal.Cfg{})
+	if err := p.Connect("/test/req/breaker/probe"); err != nil {
+		t.Error(err)
+	}
+
+	var healthy int32
+	go func() {
+		for {
+			v, err := p.RecvErr()
+			if err != nil {
+				return
+			} else if atomic.LoadInt32(&healthy) != 0 {
+				p.Send(v)
+			}
+		}
+	}()
+
+	expect := func(to BreakerState) {
+		select {
+		case ev := <-events:
+			if ev.To != to {
+				t.Errorf("expected transition to %s, got %s", to, ev.To)
+			}
+		case <-time.After(time.Millisecond * 200):
+			t.Fatalf("no transition to %s", to)
+		}
+	}
+
+	request := func(d time.Duration) error {
+		c, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+
+		_, err := r.Request(c, true)
+		return err
+	}
+
+	// the request times out, and the circuit opens
+	if err := request(time.Millisecond * 40); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	expect(BreakerOpen)
+	expect(BreakerHalfOpen)
+
+	// the probe is abandoned before it times out
+	if err := request(time.Millisecond * 10); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the next request probes the circuit in its place
+	atomic.StoreInt32(&healthy, 1)
+	if err := request(time.Millisecond * 200); err != nil {
+		t.Error(err)
+	}
+	expect(BreakerClosed)
+}
+
+func TestStreamIsolation(t *testing.T) {
+	const nSlow = 32
+
+	r := New(portal.Cfg{Size: nSlow}) // room for the slow stream's replies
+	if err := r.Bind("/test/req/stream/isolation"); err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	p := rep.New(portal.Cfg{Size: nSlow})
+	if err := p.Connect("/test/req/stream/isolation"); err != nil {
+		t.Error(err)
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	go func(rc rep.Context) {
+		for {
+			v, err := rc.RecvErr()
+			if err != nil {
+				return
+			}
+
+			n, ok := v.(int)
+			if !ok {
+				rc.Send(v)
+				continue
+			}
+
+			s, err := rc.Stream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 0; i < n; i++ {
+				s.Send(c, i)
+			}
+			s.Close(nil)
+		}
+	}(p.OpenContext())
+
+	next := func(s Stream, expected interface{}) {
+		t.Helper()
+
+		if v, err := s.Next(); err != nil {
+			t.Fatal(err)
+		} else if v != expected {
+			t.Errorf("expected %v, got %v", expected, v)
+		}
+	}
+
+	// nobody consumes the slow stream for now
+	slow := r.Stream(c, nSlow)
+	defer slow.Close()
+	time.Sleep(time.Millisecond * 10)
+
+	fast := r.Stream(c, 3)
+	for i := 0; i < 3; i++ {
+		next(fast, i)
+	}
+	if _, err := fast.Next(); err != io.EOF {
+		t.Errorf("expected %s, got %v", io.EOF, err)
+	}
+
+	if v, err := r.Request(c, "ping"); err != nil {
+		t.Error(err)
+	} else if v != "ping" {
+		t.Errorf("expected ping, got %v", v)
+	}
+
+	for i := 0; i < nSlow; i++ {
+		next(slow, i)
+	}
+	if _, err := slow.Next(); err != io.EOF {
+		t.Errorf("expected %s, got %v", io.EOF, err)
+	}
+}
+
+func TestStreamOverflow(t *testing.T) {
+	const nMsg = 8
+
+	// serve streams of nMsg replies, which are queued by the REQ portal until
+	// they are consumed
+	serve := func(t *testing.T, addr string) <-chan context.Context {
+		p := rep.New(portal.Cfg{Size: nMsg})
+		if err := p.Connect(addr); err != nil {
+			t.Error(err)
+		}
+
+		ch := make(chan context.Context, 1)
+		go func(rc rep.Context) {
+			if _, err := rc.RecvErr(); err != nil {
+				t.Error(err)
+				return
+			}
+
+			s, err := rc.Stream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ch <- s.Context()
+
+			for i := 0; i < nMsg; i++ {
+				s.Send(context.Background(), i)
+			}
+			s.Close(nil)
+		}(p.OpenContext())
+		return ch
+	}
+
+	expect := func(t *testing.T, s Stream, vs ...interface{}) {
+		t.Helper()
+
+		for _, expected := range vs {
+			if v, err := s.Next(); err != nil {
+				t.Fatal(err)
+			} else if v != expected {
+				t.Errorf("expected %v, got %v", expected, v)
+			}
+		}
+	}
+
+	t.Run("Block", func(t *testing.T) {
+		r := New(portal.Cfg{Size: 2})
+		if err := r.Bind("/test/req/stream/overflow/block"); err != nil {
+			t.Error(err)
+		}
+		defer r.Close()
+
+		sc := serve(t, "/test/req/stream/overflow/block")
+
+		c, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		s := r.Stream(c, true)
+		time.Sleep(time.Millisecond * 20) // nobody consumes the stream for now
+
+		expect(t, s, 0, 1)
+		if _, err := s.Next(); err != ErrStreamOverflow {
+			t.Errorf("expected %s, got %v", ErrStreamOverflow, err)
+		}
+
+		// the REP portal is informed that the stream was abandoned
+		select {
+		case <-(<-sc).Done():
+		case <-time.After(time.Millisecond * 100):
+			t.Error("stream context did not expire")
+		}
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		r := New(portal.Cfg{Size: 2, Overflow: portal.DropOldest})
+		if err := r.Bind("/test/req/stream/overflow/dropoldest"); err != nil {
+			t.Error(err)
+		}
+		defer r.Close()
+
+		serve(t, "/test/req/stream/overflow/dropoldest")
+
+		c, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		s := r.Stream(c, true)
+		time.Sleep(time.Millisecond * 20)
+
+		expect(t, s, nMsg-2, nMsg-1)
+		if _, err := s.Next(); err != io.EOF {
+			t.Errorf("expected %s, got %v", io.EOF, err)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package req
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMaxAttempts is returned when a request was sent RetryPolicy.MaxAttempts
+// times without receiving a reply
+var ErrMaxAttempts = errors.New("maximum attempts exceeded")
+
+// RetryPolicy governs when an outstanding request is sent again
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is sent.  Zero
+	// means no limit.
+	MaxAttempts int
+
+	// Backoff is the delay after which a request that has not been replied to
+	// is sent again.  It defaults to DefaultResendInterval.
+	Backoff time.Duration
+
+	// Multiplier scales the backoff after each attempt.  Values below 1 are
+	// treated as 1 (constant backoff).
+	Multiplier float64
+
+	// MaxBackoff caps the backoff.  Zero means no limit.
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction, between 0 and 1, of each backoff that is
+	// randomized, so that retries from many requesters do not synchronize.
+	Jitter float64
+
+	// Retryable reports whether a request whose reply is an error should be
+	// sent again.  If nil, error replies are returned to the requester.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy resends requests every DefaultResendInterval, without
+// limit
+var DefaultRetryPolicy = RetryPolicy{Backoff: DefaultResendInterval}
+
+// delay returns the backoff following the given attempt (starting at 1)
+func (rp RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(rp.Backoff)
+	if d <= 0 {
+		d = float64(DefaultResendInterval)
+	}
+
+	if rp.Multiplier > 1 {
+		d *= math.Pow(rp.Multiplier, float64(attempt-1))
+	}
+
+	if rp.MaxBackoff > 0 && d > float64(rp.MaxBackoff) {
+		d = float64(rp.MaxBackoff)
+	}
+
+	if rp.Jitter > 0 {
+		d -= d * math.Min(rp.Jitter, 1) * rand.Float64()
+	}
+
+	return time.Duration(d)
+}
+
+// exhausted reports whether a request may not be sent again after the given
+// attempt
+func (rp RetryPolicy) exhausted(attempt int) bool {
+	return rp.MaxAttempts > 0 && attempt >= rp.MaxAttempts
+}
+
+// retryable reports whether a reply causes the request to be sent again
+func (rp RetryPolicy) retryable(v interface{}) bool {
+	err, ok := v.(error)
+	return ok && rp.Retryable != nil && rp.Retryable(err)
+}
+
+// HedgePolicy governs when a duplicate of an outstanding request is sent to a
+// second REP portal.  The first reply is returned to the requester, and the
+// other REP portal is informed that the request was abandoned.  The zero value
+// disables hedging.
+type HedgePolicy struct {
+	// Percentile of recent reply latencies, between 0 and 1, after which a
+	// request is hedged.  For instance, 0.95 hedges the slowest 5% of requests.
+	Percentile float64
+
+	// Delay after which a request is hedged until enough replies have been
+	// observed to compute the percentile.  It is also a lower bound on the
+	// hedging delay.
+	Delay time.Duration
+}
+
+func (hp HedgePolicy) enabled() bool { return hp.Percentile > 0 || hp.Delay > 0 }
+
+const (
+	nLatencies = 128 // number of reply latencies retained
+	minSamples = 16  // number of reply latencies required to compute a percentile
+)
+
+// latencies retains the most recent reply latencies
+type latencies struct {
+	samples [nLatencies]time.Duration
+	n       int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.samples[l.n%nLatencies] = d
+	l.n++
+}
+
+// percentile returns the q-th percentile of the retained latencies.  It
+// returns false if too few latencies have been observed.
+func (l *latencies) percentile(q float64) (time.Duration, bool) {
+	n := l.n
+	if n > nLatencies {
+		n = nLatencies
+	}
+
+	if n < minSamples {
+		return 0, false
+	}
+
+	s := make([]time.Duration, n)
+	copy(s, l.samples[:n])
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+
+	return s[int(math.Min(q, 1)*float64(n-1))], true
+}
+
+// hedgeDelay returns the delay after which a request is hedged.  It returns
+// false if requests are not currently hedged.  The caller must hold the lock.
+func (p *Protocol) hedgeDelay() (time.Duration, bool) {
+	if !p.hedging.enabled() || len(p.peers) < 2 {
+		return 0, false
+	}
+
+	d, ok := p.latency.percentile(p.hedging.Percentile)
+	if !ok || d < p.hedging.Delay {
+		d = p.hedging.Delay
+	}
+
+	return d, d > 0
+}
+
+// SetRetryPolicy sets the policy governing when outstanding requests are sent
+// again
+func (p *Protocol) SetRetryPolicy(rp RetryPolicy) {
+	p.Lock()
+	p.policy = rp
+	p.Unlock()
+}
+
+// SetHedgePolicy sets the policy governing when outstanding requests are
+// hedged
+func (p *Protocol) SetHedgePolicy(hp HedgePolicy) {
+	p.Lock()
+	p.hedging = hp
+	p.Unlock()
+}
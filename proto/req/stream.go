@@ -0,0 +1,195 @@
+package req
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/pkg/errors"
+)
+
+// ErrInterrupted is returned by Stream.Next when the REP portal serving the
+// stream disconnects before the end of the stream
+var ErrInterrupted = errors.New("stream interrupted")
+
+// ErrStreamOverflow is returned by Stream.Next when the stream's consumer fell
+// behind by more replies than the REQ portal's buffer size, and the Overflow
+// policy is Block.  The stream is abandoned.
+var ErrStreamOverflow = errors.New("stream overflow")
+
+// Stream iterates over the replies to a streaming request
+type Stream interface {
+	// Next returns the next reply.  It returns io.EOF after the last reply,
+	// the error with which the REP portal terminated the stream, or the
+	// context's error if the stream was abandoned.
+	Next() (interface{}, error)
+
+	// Close abandons the stream.  It is not necessary to call Close once Next
+	// has returned an error.
+	Close()
+}
+
+type stream struct {
+	p      *Protocol
+	r      *request
+	c      context.Context
+	cancel context.CancelFunc
+	err    error
+}
+
+func (s *stream) Next() (interface{}, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	select {
+	case msg := <-s.r.reply:
+		v := msg.Value
+		_, eos := msg.Header[proto.HdrEOS]
+		msg.Free()
+
+		if !eos {
+			return v, nil
+		}
+
+		if s.err, _ = v.(error); s.err == nil {
+			s.err = io.EOF
+		}
+		s.cancel()
+	case <-s.c.Done():
+		s.err = s.c.Err()
+	case <-s.p.ptl.CloseChannel():
+		s.err = portal.ErrClosed
+		s.cancel()
+	}
+
+	return nil, s.err
+}
+
+func (s *stream) Close() { s.cancel() }
+
+// stream sends a streaming request
+func (p *Protocol) stream(c context.Context, v interface{}) *stream {
+	from := p.ptl.ID()
+
+	msg := portal.NewMsg()
+	msg.From = &from
+	msg.Sent = time.Now()
+	msg.Header = map[string]string{proto.HdrStream: "true"}
+	msg.Value = v
+
+	c, cancel := context.WithCancel(c)
+	r := p.register(msg, nil, c.Done()) // replies are queued by the relay
+
+	context.AfterFunc(c, func() {
+		p.abandon(r)
+		r.relay.close()
+	})
+
+	go p.transmit(r, msg, c.Done())
+
+	return &stream{p: p, r: r, c: c, cancel: cancel}
+}
+
+// relay queues the replies to a stream until its consumer is ready for them,
+// so that the REQ portal's intake never waits for a slow consumer, and other
+// requests and streams are unaffected.  The queue holds up to size replies, in
+// addition to the end of the stream, and the Overflow policy applies to each
+// stream separately.
+type relay struct {
+	sync.Mutex
+	cfg    portal.Cfg
+	size   int
+	q      chan *portal.Message
+	closed bool
+}
+
+func newRelay(cfg portal.Cfg, size int) *relay {
+	return &relay{cfg: cfg, size: size, q: make(chan *portal.Message, size+1)}
+}
+
+// push a reply onto the queue, applying the Overflow policy if it is full.  It
+// returns false if the queue is full and the policy is Block, in which case the
+// stream must be abandoned.
+func (rl *relay) push(msg *portal.Message) bool {
+	rl.Lock()
+	defer rl.Unlock()
+
+	if rl.closed {
+		msg.Free()
+		return true
+	}
+
+	// the end of the stream is always queued, and nothing is queued after it
+	if _, eos := msg.Header[proto.HdrEOS]; eos || len(rl.q) < rl.size {
+		rl.q <- msg
+		return true
+	}
+
+	switch rl.cfg.Overflow {
+	case portal.Block:
+		msg.Free()
+		return false
+	case portal.DropOldest:
+		select {
+		case old := <-rl.q:
+			old.Free()
+		default: // the consumer emptied the queue in the meantime
+		}
+		rl.q <- msg
+		return true
+	case portal.Callback:
+		if rl.cfg.OnDrop != nil {
+			rl.cfg.OnDrop(msg)
+		}
+	}
+
+	msg.Free()
+	return true
+}
+
+// close the relay, freeing the replies that will never be consumed
+func (rl *relay) close() {
+	rl.Lock()
+	rl.closed = true
+	rl.Unlock()
+
+	for {
+		select {
+		case msg := <-rl.q:
+			msg.Free()
+		default:
+			return
+		}
+	}
+}
+
+// overflow abandons a stream whose consumer fell too far behind.  The consumer
+// receives ErrStreamOverflow once it has consumed the queued replies.
+func (p *Protocol) overflow(r *request) {
+	if p.abandon(r) {
+		p.fail(r, ErrStreamOverflow)
+	}
+}
+
+// interrupt the streams served by a REP portal that disconnected
+func (p *Protocol) interrupt(id portal.ID) {
+	var rs []*request
+
+	p.Lock()
+	for _, r := range p.pending {
+		if r.started && *r.peer == id {
+			delete(p.pending, r.id)
+			r.stop()
+			rs = append(rs, r)
+		}
+	}
+	p.Unlock()
+
+	for _, r := range rs {
+		p.fail(r, ErrInterrupted)
+	}
+}
@@ -0,0 +1,102 @@
+package respondent
+
+import (
+	"sync"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+)
+
+// survey identifies a question received from a SURVEYOR portal
+type survey struct {
+	from portal.ID
+	id   uint64
+}
+
+// Protocol implementing RESPONDENT
+type Protocol struct {
+	ptl portal.ProtocolPortal
+	n   proto.Neighborhood
+
+	sync.Mutex
+	pending *survey // survey awaiting a response, if any
+}
+
+// Init the protocol (called by portal)
+func (p *Protocol) Init(ptl portal.ProtocolPortal) {
+	p.ptl = ptl
+	p.n = proto.NewNeighborhood()
+	go p.startSending()
+}
+
+// RecvHook records the survey to which the next call to Send responds
+func (p *Protocol) RecvHook(msg *portal.Message) bool {
+	if msg.From == nil {
+		return false // cannot respond to an anonymous survey
+	}
+
+	p.Lock()
+	p.pending = &survey{from: *msg.From, id: msg.ID}
+	p.Unlock()
+	return true
+}
+
+// SendHook addresses the response to the surveyor.  Responses sent when no
+// survey is pending (including second responses to the same survey) are
+// dropped.
+func (p *Protocol) SendHook(msg *portal.Message) bool {
+	p.Lock()
+	s := p.pending
+	p.pending = nil
+	p.Unlock()
+
+	if s == nil {
+		return false
+	}
+
+	msg.To = &s.from
+	msg.ReplyTo = s.id
+	return true
+}
+
+func (p *Protocol) startSending() {
+	sq := p.ptl.SendChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-sq:
+			if peer, ok := p.n.GetPeer(*msg.To); ok {
+				proto.Deliver(peer, msg, cq)
+			} else {
+				msg.Free() // surveyor went away
+			}
+		}
+	}
+}
+
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
+	proto.MustBeCompatible(p, ep.Signature())
+	p.n.SetPeer(ep.ID(), ep)
+}
+
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
+
+func (*Protocol) Number() uint16     { return proto.Resp }
+func (*Protocol) PeerNumber() uint16 { return proto.Surv }
+func (*Protocol) Name() string       { return "respondent" }
+func (*Protocol) PeerName() string   { return "surveyor" }
+
+// New allocates a portal using the RESPONDENT protocol.  Each call to Recv
+// returns a survey, to which the next call to Send responds.  Responses sent
+// without a pending survey are dropped, so that each survey receives at most
+// one response.  RESPONDENT portals should therefore be used from a single
+// goroutine.
+func New(cfg portal.Cfg) portal.Portal {
+	return portal.MakePortal(cfg, &Protocol{})
+}
+
+// NewOf allocates a type-safe portal using the RESPONDENT protocol
+func NewOf[T any](cfg portal.Cfg) portal.Typed[T] { return portal.Typed[T]{Portal: New(cfg)} }
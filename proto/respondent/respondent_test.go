@@ -0,0 +1,111 @@
+package respondent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/surveyor"
+)
+
+func TestIntegration(t *testing.T) {
+	const nSurv = 2
+
+	r := New(portal.Cfg{})
+	if err := r.Bind("/test/respondent/integration"); err != nil {
+		t.Error(err)
+	}
+
+	survs := make([]surveyor.Portal, nSurv)
+	for i := range survs {
+		survs[i] = surveyor.New(portal.Cfg{})
+		survs[i].SetDeadline(time.Millisecond * 50)
+		if err := survs[i].Connect("/test/respondent/integration"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Run("Routing", func(t *testing.T) {
+		ch := make(chan portal.ID, nSurv)
+		go func() {
+			for range survs {
+				env, err := r.RecvEnvelope(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				ch <- env.From
+				r.Send(env.Value.(int) * 10)
+			}
+		}()
+
+		// each response MUST be delivered to the surveyor that asked for it
+		for i, s := range survs {
+			s.Send(i)
+
+			if id := <-ch; id != s.ID() {
+				t.Errorf("survey %d tagged with wrong surveyor %s", i, id)
+			}
+
+			if v, err := s.RecvErr(); err != nil {
+				t.Errorf("surveyor %d: %s", i, err)
+			} else if v.(int) != i*10 {
+				t.Errorf("surveyor %d: unexpected response (expected %d, got %v)", i, i*10, v)
+			}
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		s := survs[0]
+
+		ch := make(chan struct{})
+		go func() {
+			v := r.Recv()
+			<-ch // respond after the deadline
+			r.Send(v)
+
+			// the respondent answers the next survey as usual
+			r.Send(r.Recv().(int) * 10)
+		}()
+
+		s.Send(1)
+		time.Sleep(time.Millisecond * 60)
+		close(ch)
+
+		if v, err := s.RecvErr(); err != surveyor.ErrSurveyExpired {
+			t.Errorf("expected %s, got %v (%v)", surveyor.ErrSurveyExpired, err, v)
+		}
+
+		// the late response MUST NOT be delivered
+		s.Send(2)
+
+		if v, err := s.RecvErr(); err != nil {
+			t.Error(err)
+		} else if v.(int) != 20 {
+			t.Errorf("unexpected response (expected 20, got %v)", v)
+		}
+	})
+
+	t.Run("NoSurvey", func(t *testing.T) {
+		s := survs[1]
+
+		go func() {
+			r.Send(-1) // there is no pending survey, so it MUST be dropped
+			r.Send(r.Recv().(int) * 10)
+		}()
+
+		s.Send(3)
+
+		if v, err := s.RecvErr(); err != nil {
+			t.Error(err)
+		} else if v.(int) != 30 {
+			t.Errorf("unexpected response (expected 30, got %v)", v)
+		}
+
+		if v, err := s.RecvErr(); err != surveyor.ErrSurveyExpired {
+			t.Errorf("expected %s, got %v (%v)", surveyor.ErrSurveyExpired, err, v)
+		}
+	})
+}
@@ -110,7 +110,7 @@ func (p Protocol) broadcast(wg *sync.WaitGroup, msg *portal.Message) (wgout *syn
 		go p.unicast(wg, peer.(msgSender), msg)
 	}
 
-	if msg.From != nil { // Grab a local copy and send it up
+	if *msg.From != p.ptl.ID() { // Grab a local copy and send it up
 		select {
 		case <-p.ptl.CloseChannel():
 			msg.Free()
@@ -0,0 +1,149 @@
+package sub
+
+import (
+	"context"
+
+	"github.com/SentimensRG/ctx"
+	"github.com/lthibault/portal"
+)
+
+// Subscription is a dedicated receive queue for a topic (see
+// Portal.SubscribeStream).  Values matching its topic are queued for the
+// Subscription rather than the SUB portal's shared receive queue, unless the
+// SUB portal is also subscribed to the topic.
+type Subscription interface {
+	// Topic to which the Subscription is subscribed
+	Topic() Topic
+
+	// Recv a value.  It returns nil if the Subscription is closed.
+	Recv() interface{}
+
+	// RecvCtx is like Recv, but returns early if the context expires.  It
+	// returns portal.ErrClosed if the Subscription or the SUB portal was
+	// closed.
+	RecvCtx(context.Context) (interface{}, error)
+
+	// RecvEnvelope is like RecvCtx, but additionally returns the message's
+	// metadata
+	RecvEnvelope(context.Context) (portal.Envelope, error)
+
+	// TryRecv receives a value without blocking.  It returns false if no
+	// value is available.
+	TryRecv() (interface{}, bool)
+
+	// Len returns the number of queued values
+	Len() int
+
+	// Close unsubscribes from the topic.  Queued values are discarded.
+	Close()
+}
+
+type stream struct {
+	topic  Topic
+	cfg    portal.Cfg
+	q      chan *portal.Message
+	subs   *subscription
+	cancel func()
+}
+
+func newStream(t Topic, cfg portal.Cfg, subs *subscription, cq <-chan struct{}) *stream {
+	d := ctx.Doner(ctx.Lift(cq))
+	if cfg.Doner != nil {
+		d = ctx.Link(d, cfg.Doner)
+	}
+
+	st := &stream{topic: t, q: make(chan *portal.Message, cfg.Size), subs: subs}
+	st.cfg.Doner, st.cancel = ctx.WithCancel(d)
+	st.cfg.Size, st.cfg.Overflow, st.cfg.OnDrop = cfg.Size, cfg.Overflow, cfg.OnDrop
+
+	ctx.Defer(st, func() {
+		subs.removeStream(st)
+		st.drain()
+	})
+
+	return st
+}
+
+// match reports whether msg belongs to the stream's topic.  Patterns are
+// matched against the message's topic, as with the shared receive queue.
+func (st *stream) match(msg *portal.Message) bool {
+	if p, ok := st.topic.(Pattern); ok {
+		topic, ok := topicOf(msg)
+		return ok && p.matches(topic)
+	}
+	return st.topic.Match(msg.Value)
+}
+
+// enqueue msg, applying the stream's overflow policy
+func (st *stream) enqueue(msg *portal.Message) {
+	st.cfg.Enqueue(st.q, msg, st.Done())
+
+	select {
+	case <-st.Done():
+		st.drain() // the stream was closed while msg was being enqueued
+	default:
+	}
+}
+
+func (st *stream) drain() {
+	for {
+		select {
+		case msg := <-st.q:
+			msg.Free()
+		default:
+			return
+		}
+	}
+}
+
+func (st *stream) recvMsg(c context.Context) (*portal.Message, error) {
+	select {
+	case msg := <-st.q:
+		return msg, nil
+	case <-c.Done():
+		return nil, c.Err()
+	case <-st.Done():
+		return nil, portal.ErrClosed
+	}
+}
+
+func (st *stream) Done() <-chan struct{} { return st.cfg.Done() }
+
+func (st *stream) Topic() Topic { return st.topic }
+
+func (st *stream) Recv() (v interface{}) {
+	v, _ = st.RecvCtx(context.Background())
+	return
+}
+
+func (st *stream) RecvCtx(c context.Context) (v interface{}, err error) {
+	var msg *portal.Message
+	if msg, err = st.recvMsg(c); msg != nil {
+		v = msg.Value
+		msg.Free()
+	}
+	return
+}
+
+func (st *stream) RecvEnvelope(c context.Context) (env portal.Envelope, err error) {
+	var msg *portal.Message
+	if msg, err = st.recvMsg(c); msg != nil {
+		env = portal.NewEnvelope(msg)
+		msg.Free()
+	}
+	return
+}
+
+func (st *stream) TryRecv() (v interface{}, ok bool) {
+	select {
+	case msg := <-st.q:
+		v, ok = msg.Value, true
+		msg.Free()
+	default:
+	}
+	return
+}
+
+func (st *stream) Len() int { return len(st.q) }
+
+func (st *stream) Close() { st.cancel() }
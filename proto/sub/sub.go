@@ -1,6 +1,7 @@
 package sub
 
 import (
+	"reflect"
 	"sync"
 
 	"github.com/lthibault/portal"
@@ -13,40 +14,163 @@ type Topic interface {
 	Match(interface{}) bool
 }
 
-// TopicFunc turns a `func(interface{}) bool` into a Topic
+// ErrIncomparableTopic is returned when subscribing to a topic that cannot be
+// compared, and therefore could not be unsubscribed from.  Functions cannot be
+// compared, so subscribe to a pointer to a TopicFunc instead.
+var ErrIncomparableTopic = errors.New("topic cannot be compared")
+
+// TopicFunc turns a `func(interface{}) bool` into a Topic.  Subscribe and
+// Unsubscribe with a pointer to the TopicFunc (see ErrIncomparableTopic).
 type TopicFunc func(interface{}) bool
 
 // Match returns true if the interface matches the topic rule
 func (f TopicFunc) Match(v interface{}) bool { return f(v) }
 
+// TopicOf is a type-safe Topic
+type TopicOf[T any] interface {
+	Match(T) bool
+}
+
+// TopicFuncOf turns a `func(T) bool` into a TopicOf[T]
+type TopicFuncOf[T any] func(T) bool
+
+// Match returns true if the value matches the topic rule
+func (f TopicFuncOf[T]) Match(v T) bool { return f(v) }
+
+// typedTopic adapts a TopicOf[T] to Topic.  Values that are not of type T never
+// match.
+type typedTopic[T any] struct{ TopicOf[T] }
+
+func (t typedTopic[T]) Match(v interface{}) bool {
+	tv, ok := v.(T)
+	return ok && t.TopicOf.Match(tv)
+}
+
+// builtinTopic is comparable, so that the built-in topics can be unsubscribed
+// from
+type builtinTopic uint8
+
+const (
+	topicAll builtinTopic = iota
+	topicNone
+	topicNotNil
+)
+
+func (t builtinTopic) Match(v interface{}) bool {
+	switch t {
+	case topicAll:
+		return true
+	case topicNotNil:
+		return v != nil
+	default:
+		return false
+	}
+}
+
 var (
 	// TopicAll includes all values received on the SUB portal
-	TopicAll TopicFunc = func(interface{}) bool { return true }
+	TopicAll Topic = topicAll
 
 	// TopicNone does not accept anything
-	TopicNone TopicFunc = func(interface{}) (ok bool) { return }
+	TopicNone Topic = topicNone
 
 	// TopicNotNil includes all values that are not nil
-	TopicNotNil TopicFunc = func(v interface{}) bool { return v != nil }
+	TopicNotNil Topic = topicNotNil
 )
 
+// isComparable returns true if t can be compared to other topics
+func isComparable(t Topic) bool { return reflect.ValueOf(t).Comparable() }
+
 type subscription struct {
 	sync.RWMutex
-	t []Topic
+	t        []Topic
+	patterns topicTree
+	streams  []*stream
+}
+
+// Match returns true if msg matches any subscription, including those with a
+// dedicated stream.  It is the filter advertised to PUB portals.
+func (s *subscription) Match(msg *portal.Message) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.match(msg) {
+		return true
+	}
+
+	for _, st := range s.streams {
+		if st.match(msg) {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *subscription) Match(v interface{}) (matched bool) {
+// matchShared returns true if msg matches a topic of the shared receive queue
+func (s *subscription) matchShared(msg *portal.Message) bool {
 	s.RLock()
+	defer s.RUnlock()
+
+	return s.match(msg)
+}
+
+// match returns true if msg matches a topic of the shared receive queue.  The
+// caller must hold the lock.
+func (s *subscription) match(msg *portal.Message) (matched bool) {
+	if topic, ok := topicOf(msg); ok && s.patterns.Len() > 0 {
+		if s.patterns.match(topic) {
+			return true
+		}
+	}
+
 	for _, t := range s.t {
-		if matched = t.Match(v); matched {
+		if matched = t.Match(msg.Value); matched {
 			break
 		}
 	}
-	s.RUnlock()
 	return
 }
 
+// route returns the streams to which msg is delivered, and whether it is also
+// delivered to the shared receive queue
+func (s *subscription) route(msg *portal.Message) (sts []*stream, shared bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, st := range s.streams {
+		if st.match(msg) {
+			sts = append(sts, st)
+		}
+	}
+
+	return sts, s.match(msg)
+}
+
+func (s *subscription) addStream(st *stream) {
+	s.Lock()
+	s.streams = append(s.streams, st)
+	s.Unlock()
+}
+
+func (s *subscription) removeStream(st *stream) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, x := range s.streams {
+		if x == st {
+			s.streams = append(s.streams[:i], s.streams[i+1:]...)
+			return
+		}
+	}
+}
+
 func (s *subscription) Subscribe(t Topic) (err error) {
+	if p, ok := t.(Pattern); ok {
+		return s.subscribePattern(p)
+	} else if !isComparable(t) {
+		return ErrIncomparableTopic
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
@@ -60,10 +184,31 @@ func (s *subscription) Subscribe(t Topic) (err error) {
 	return
 }
 
+func (s *subscription) subscribePattern(p Pattern) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, updated := s.patterns.Insert(string(p), struct{}{}); updated {
+		return errors.New("already subscribed to topic")
+	}
+	return nil
+}
+
 func (s *subscription) Unsubscribe(t Topic) {
 	s.Lock()
 	defer s.Unlock()
 
+	if p, ok := t.(Pattern); ok {
+		s.patterns.Delete(string(p))
+		return
+	} else if !isComparable(t) {
+		return // never subscribed
+	}
+
 	for i, tpc := range s.t {
 		if tpc == t {
 			s.t[i] = s.t[len(s.t)-1]
@@ -80,45 +225,137 @@ type Protocol struct {
 
 func (p *Protocol) Init(ptl portal.ProtocolPortal) {
 	p.ptl = ptl
-	p.subs = &subscription{t: make([]Topic, 0)}
+	p.subs = &subscription{t: make([]Topic, 0), patterns: newTopicTree()}
 }
 
-func (p Protocol) startReceiving(ep portal.Endpoint) {
+// Intake routes messages to the streams whose topic they match (see
+// SubscribeStream), and to the shared receive queue if they match one of its
+// topics.  The PUB protocol is responsible for fan-out, and only sends the
+// messages that matched the subscriptions when it sent them (see AddEndpoint).
+func (p Protocol) Intake(in <-chan *portal.Message) { go p.startRouting(in) }
+
+func (p Protocol) startRouting(in <-chan *portal.Message) {
 	rq := p.ptl.RecvChannel()
 	cq := p.ptl.CloseChannel()
 
-	for msg := range ep.SendChannel() {
-		if p.subs.Match(msg.Value) {
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-in:
+			sts, shared := p.subs.route(msg)
+			for _, st := range sts {
+				st.enqueue(msg.Ref())
+			}
+
+			if !shared {
+				msg.Free()
+				continue
+			}
+
 			select {
 			case rq <- msg:
 			case <-cq:
+				msg.Free()
 				return
 			}
-		} else {
-			msg.Free()
 		}
 	}
 }
 
+// RecvHook drops messages that no longer match a topic of the shared receive
+// queue, e.g. because of a call to Unsubscribe after they were queued
+func (p Protocol) RecvHook(msg *portal.Message) bool { return p.subs.matchShared(msg) }
+
 func (Protocol) Number() uint16     { return proto.Sub }
 func (Protocol) PeerNumber() uint16 { return proto.Pub }
 func (Protocol) Name() string       { return "sub" }
 func (Protocol) PeerName() string   { return "pub" }
 
 func (Protocol) RemoveEndpoint(portal.Endpoint) {}
+
+// AddEndpoint advertises the subscriptions to the PUB portal, so that it only
+// sends matching messages.  The advertised filter reflects subsequent calls to
+// Subscribe and Unsubscribe.
 func (p Protocol) AddEndpoint(ep portal.Endpoint) {
 	proto.MustBeCompatible(p, ep.Signature())
-	go p.startReceiving(ep)
+
+	from := p.ptl.ID()
+
+	msg := portal.NewMsg()
+	msg.From = &from
+	msg.Header = map[string]string{proto.HdrSubscribe: "true"}
+	msg.Value = p.subs
+	go proto.Deliver(ep, msg, p.ptl.CloseChannel())
 }
 
 func (p Protocol) Subscribe(t Topic) error { return p.subs.Subscribe(t) }
 func (p Protocol) Unsubscribe(t Topic)     { p.subs.Unsubscribe(t) }
 
-// Portal adds the (Un)Subscribe methods to portal.ReadOnly
+// SubscribeStream subscribes to a topic with a dedicated receive queue, whose
+// size and overflow policy are given by cfg.  If cfg.Doner is set, the
+// Subscription is closed when it expires.
+func (p Protocol) SubscribeStream(t Topic, cfg portal.Cfg) (Subscription, error) {
+	if pt, ok := t.(Pattern); ok {
+		if err := pt.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	st := newStream(t, cfg, p.subs, p.ptl.CloseChannel())
+	p.subs.addStream(st)
+	return st, nil
+}
+
+// Portal adds the (Un)Subscribe methods to portal.ReadOnly.  Subscribing to a
+// Pattern matches the topic of each message (see Topical and proto.HdrTopic)
+// rather than its value.  Subscribe returns ErrIncomparableTopic if the topic
+// cannot be compared, since it could not be unsubscribed from.
 type Portal interface {
 	portal.ReadOnly
 	Subscribe(Topic) error
 	Unsubscribe(Topic)
+
+	// SubscribeStream subscribes to a topic with a dedicated receive queue,
+	// whose size and overflow policy are given by the Cfg.  Matching values
+	// are received from the Subscription rather than the Portal, so that the
+	// goroutines owning different topics do not share a queue.  Unsubscribe
+	// does not affect streams; close the Subscription instead.
+	//
+	// A Subscription whose overflow policy is portal.Block applies
+	// backpressure to the whole SUB portal when it is full.
+	SubscribeStream(Topic, portal.Cfg) (Subscription, error)
+}
+
+// PortalOf is a type-safe Portal
+type PortalOf[T any] struct {
+	portal.TypedReadOnly[T]
+	subs Portal
+}
+
+// Subscribe to a typed topic.  Typed topics are often functions, which cannot
+// be compared, so the subscription is identified by the returned Topic.
+func (p PortalOf[T]) Subscribe(t TopicOf[T]) (Topic, error) {
+	h := &typedTopic[T]{t}
+	return h, p.subs.Subscribe(h)
+}
+
+// Unsubscribe from a typed topic, identified by the Topic returned by Subscribe
+func (p PortalOf[T]) Unsubscribe(h Topic) { p.subs.Unsubscribe(h) }
+
+// SubscribeStream subscribes to a typed topic with a dedicated receive queue.
+// Values received from the Subscription are of type T.
+func (p PortalOf[T]) SubscribeStream(t TopicOf[T], cfg portal.Cfg) (Subscription, error) {
+	return p.subs.SubscribeStream(typedTopic[T]{t}, cfg)
+}
+
+// Untyped returns the underlying Portal, e.g. to subscribe to untyped topics
+func (p PortalOf[T]) Untyped() Portal { return p.subs }
+
+// NewOf allocates a type-safe portal using the SUB protocol
+func NewOf[T any](cfg portal.Cfg) PortalOf[T] {
+	p := New(cfg)
+	return PortalOf[T]{TypedReadOnly: portal.TypedReadOnly[T]{ReadOnly: p}, subs: p}
 }
 
 // New allocates a portal using the SUB protocol
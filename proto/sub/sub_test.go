@@ -0,0 +1,333 @@
+package sub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/lthibault/portal/proto/pub"
+	"github.com/pkg/errors"
+)
+
+type reading struct{ room string }
+
+func (r reading) Topic() string { return "sensors/" + r.room + "/temp" }
+
+func TestPattern(t *testing.T) {
+	t.Run("Validate", func(t *testing.T) {
+		for _, p := range []Pattern{"a/#/b", "a/b+", "a#"} {
+			if err := p.validate(); errors.Cause(err) != ErrInvalidPattern {
+				t.Errorf("%s: expected %s, got %v", p, ErrInvalidPattern, err)
+			}
+		}
+
+		for _, p := range []Pattern{"#", "+", "a/+/b", "a/#", "+/+/#"} {
+			if err := p.validate(); err != nil {
+				t.Errorf("%s: %s", p, err)
+			}
+		}
+	})
+
+	t.Run("Match", func(t *testing.T) {
+		for _, tc := range []struct {
+			pattern Pattern
+			topic   string
+			match   bool
+		}{
+			{"sensors/+/temp", "sensors/kitchen/temp", true},
+			{"sensors/+/temp", "sensors/kitchen/humidity", false},
+			{"sensors/+/temp", "sensors/temp", false},
+			{"logs/#", "logs", true},
+			{"logs/#", "logs/app/error", true},
+			{"logs/#", "logsy", false},
+			{"#", "a/b/c", true},
+			{"+", "a", true},
+			{"+", "a/b", false},
+			{"a/b", "a/b", true},
+			{"a/b", "a/b/c", false},
+		} {
+			if m := tc.pattern.matches(tc.topic); m != tc.match {
+				t.Errorf("%s ~ %s: expected %t, got %t", tc.pattern, tc.topic, tc.match, m)
+			}
+
+			tree := newTopicTree()
+			tree.Insert(string(tc.pattern), struct{}{})
+			if m := tree.match(tc.topic); m != tc.match {
+				t.Errorf("trie: %s ~ %s: expected %t, got %t", tc.pattern, tc.topic, tc.match, m)
+			}
+		}
+	})
+
+	t.Run("Trie", func(t *testing.T) {
+		levels := []string{"a", "b", "+", "#"}
+
+		// every pattern of up to three levels
+		var patterns []Pattern
+		var gen func(prefix []string)
+		gen = func(prefix []string) {
+			if len(prefix) > 0 {
+				if p := Pattern(strings.Join(prefix, "/")); p.validate() == nil {
+					patterns = append(patterns, p)
+				}
+			}
+			if len(prefix) < 3 {
+				for _, l := range levels {
+					gen(append(prefix[:len(prefix):len(prefix)], l))
+				}
+			}
+		}
+		gen(nil)
+
+		topics := []string{"a", "b", "a/a", "a/b", "b/a", "a/b/a", "b/b/b", "a/b/a/b"}
+
+		// subscribe to each pattern alongside another one, and compare the
+		// trie with the reference implementation
+		for i, p := range patterns {
+			tree := newTopicTree()
+			tree.Insert(string(p), struct{}{})
+			other := patterns[(i*7)%len(patterns)]
+			tree.Insert(string(other), struct{}{})
+
+			for _, topic := range topics {
+				expected := p.matches(topic) || other.matches(topic)
+				if m := tree.match(topic); m != expected {
+					t.Errorf("{%s, %s} ~ %s: expected %t, got %t", p, other, topic, expected, m)
+				}
+			}
+		}
+	})
+}
+
+func TestSubscribePattern(t *testing.T) {
+	p := pub.New(portal.Cfg{Size: 8})
+	if err := p.Bind("/test/sub/pattern"); err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	s := New(portal.Cfg{Size: 8})
+	for _, pattern := range []Pattern{"sensors/+/temp", "logs/#"} {
+		if err := s.Subscribe(pattern); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.Subscribe(Pattern("logs/#")); err == nil {
+		t.Error("subscribed twice to the same pattern")
+	}
+	if err := s.Connect("/test/sub/pattern"); err != nil {
+		t.Error(err)
+	}
+
+	c := context.Background()
+	for _, env := range []portal.Envelope{
+		{Value: reading{"kitchen"}},
+		{Value: "nope", Header: map[string]string{proto.HdrTopic: "sensors/kitchen/humidity"}},
+		{Value: "untopical"},
+		{Value: "error", Header: map[string]string{proto.HdrTopic: "logs/app/error"}},
+	} {
+		if err := p.SendEnvelope(c, env); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, expected := range []interface{}{reading{"kitchen"}, "error"} {
+		c, cancel := context.WithTimeout(c, time.Millisecond*100)
+		v, err := s.RecvCtx(c)
+		cancel()
+
+		if err != nil {
+			t.Fatal(err)
+		} else if v != expected {
+			t.Errorf("expected %v, got %v", expected, v)
+		}
+	}
+
+	s.Unsubscribe(Pattern("logs/#"))
+	p.SendEnvelope(c, portal.Envelope{Value: "gone", Header: map[string]string{proto.HdrTopic: "logs/app"}})
+	time.Sleep(time.Millisecond * 10)
+
+	if v, ok := s.TryRecv(); ok {
+		t.Errorf("received %v after unsubscribing", v)
+	}
+}
+
+func TestSubscribeStream(t *testing.T) {
+	p := pub.New(portal.Cfg{Size: 8})
+	if err := p.Bind("/test/sub/stream"); err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	s := New(portal.Cfg{Size: 8})
+	if err := s.Subscribe(Pattern("logs/#")); err != nil {
+		t.Error(err)
+	}
+
+	temps, err := s.SubscribeStream(Pattern("sensors/+/temp"), portal.Cfg{Size: 8})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// never read, so that it overflows
+	slow, err := s.SubscribeStream(Pattern("sensors/#"), portal.Cfg{Size: 1, Overflow: portal.DropOldest})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = s.SubscribeStream(Pattern("sensors/#/temp"), portal.Cfg{}); errors.Cause(err) != ErrInvalidPattern {
+		t.Errorf("expected %s, got %v", ErrInvalidPattern, err)
+	}
+
+	if err := s.Connect("/test/sub/stream"); err != nil {
+		t.Error(err)
+	}
+
+	c := context.Background()
+	for _, env := range []portal.Envelope{
+		{Value: reading{"kitchen"}},
+		{Value: "error", Header: map[string]string{proto.HdrTopic: "logs/app/error"}},
+		{Value: reading{"cellar"}},
+	} {
+		if err := p.SendEnvelope(c, env); err != nil {
+			t.Error(err)
+		}
+	}
+
+	recv := func(t *testing.T, r func(context.Context) (interface{}, error), expected interface{}) {
+		t.Helper()
+
+		c, cancel := context.WithTimeout(c, time.Millisecond*100)
+		defer cancel()
+
+		if v, err := r(c); err != nil {
+			t.Fatal(err)
+		} else if v != expected {
+			t.Errorf("expected %v, got %v", expected, v)
+		}
+	}
+
+	recv(t, temps.RecvCtx, reading{"kitchen"})
+	recv(t, temps.RecvCtx, reading{"cellar"})
+	recv(t, s.RecvCtx, "error")
+	recv(t, slow.RecvCtx, reading{"cellar"})
+
+	if v, ok := s.TryRecv(); ok {
+		t.Errorf("shared queue received %v", v)
+	}
+
+	temps.Close()
+	if _, err = temps.RecvCtx(c); err != portal.ErrClosed {
+		t.Errorf("expected %s, got %v", portal.ErrClosed, err)
+	}
+
+	p.Send(reading{"attic"})
+	recv(t, slow.RecvCtx, reading{"attic"})
+
+	slow.Close()
+	p.Send(reading{"garage"})
+	time.Sleep(time.Millisecond * 10)
+
+	if v, ok := s.TryRecv(); ok {
+		t.Errorf("shared queue received %v", v)
+	}
+}
+
+func TestSubscribeTyped(t *testing.T) {
+	p := pub.New(portal.Cfg{Size: 8})
+	if err := p.Bind("/test/sub/typed"); err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	s := NewOf[int](portal.Cfg{Size: 8})
+	even, err := s.Subscribe(TopicFuncOf[int](func(i int) bool { return i%2 == 0 }))
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = s.Subscribe(TopicFuncOf[int](func(i int) bool { return i > 10 })); err != nil {
+		t.Error(err)
+	}
+	if err := s.Connect("/test/sub/typed"); err != nil {
+		t.Error(err)
+	}
+
+	s.Unsubscribe(even)
+
+	for _, i := range []int{2, 11, 4, 12} {
+		p.Send(i)
+	}
+
+	for _, expected := range []int{11, 12} {
+		c, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		v, err := s.RecvCtx(c)
+		cancel()
+
+		if err != nil {
+			t.Fatal(err)
+		} else if v != expected {
+			t.Errorf("expected %d, got %d", expected, v)
+		}
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	p := pub.New(portal.Cfg{Size: 8})
+	if err := p.Bind("/test/sub/unsubscribe"); err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	s := New(portal.Cfg{Size: 8})
+	if err := s.Subscribe(TopicAll); err != nil {
+		t.Error(err)
+	}
+	if err := s.Subscribe(TopicAll); err == nil {
+		t.Error("duplicate subscription was accepted")
+	}
+
+	two := TopicFunc(func(v interface{}) bool { return v == 2 })
+	if err := s.Subscribe(two); err != ErrIncomparableTopic {
+		t.Errorf("expected %s, got %v", ErrIncomparableTopic, err)
+	}
+	if err := s.Subscribe(&two); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Connect("/test/sub/unsubscribe"); err != nil {
+		t.Error(err)
+	}
+
+	recv := func(expected ...int) {
+		for _, i := range expected {
+			c, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			v, err := s.RecvCtx(c)
+			cancel()
+
+			if err != nil {
+				t.Fatal(err)
+			} else if v != i {
+				t.Errorf("expected %d, got %v", i, v)
+			}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+		if v, ok := s.TryRecv(); ok {
+			t.Errorf("unexpected value %v", v)
+		}
+	}
+
+	p.Send(1)
+	recv(1)
+
+	s.Unsubscribe(TopicAll)
+	p.Send(1)
+	p.Send(2)
+	recv(2)
+
+	s.Unsubscribe(&two)
+	p.Send(2)
+	recv()
+}
@@ -0,0 +1,125 @@
+package sub
+
+import (
+	"strings"
+
+	radix "github.com/armon/go-radix"
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidPattern is returned when subscribing to a malformed Pattern
+var ErrInvalidPattern = errors.New("invalid topic pattern")
+
+// Topical values report the topic under which they are published, unless the
+// message's header specifies one (see proto.HdrTopic)
+type Topical interface {
+	Topic() string
+}
+
+// Pattern is a hierarchical topic whose levels are separated by '/'.  In the
+// style of MQTT, the '+' wildcard matches exactly one level, and the '#'
+// wildcard, which must be the last level, matches any number of levels
+// (including none).  For instance, "sensors/+/temp" matches
+// "sensors/kitchen/temp", and "logs/#" matches "logs" and "logs/app/error".
+//
+// Patterns subscribed to by a SUB portal are matched against the topic of each
+// message using a trie, so matching cost does not grow with the number of
+// subscriptions.
+type Pattern string
+
+// Match returns true if v is Topical, and its topic matches the pattern
+func (p Pattern) Match(v interface{}) bool {
+	t, ok := v.(Topical)
+	return ok && p.matches(t.Topic())
+}
+
+func (p Pattern) matches(topic string) bool {
+	ps, ts := strings.Split(string(p), "/"), strings.Split(topic, "/")
+	for i, l := range ps {
+		if l == "#" {
+			return true
+		} else if i == len(ts) || (l != "+" && l != ts[i]) {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+func (p Pattern) validate() error {
+	levels := strings.Split(string(p), "/")
+	for i, l := range levels {
+		switch {
+		case l == "#" && i != len(levels)-1:
+			return errors.Wrapf(ErrInvalidPattern, "%s: '#' must be the last level", p)
+		case l != "+" && l != "#" && strings.ContainsAny(l, "+#"):
+			return errors.Wrapf(ErrInvalidPattern, "%s: wildcards must occupy a whole level", p)
+		}
+	}
+	return nil
+}
+
+// topicOf returns the topic of a message
+func topicOf(msg *portal.Message) (string, bool) {
+	if t, ok := msg.Header[proto.HdrTopic]; ok {
+		return t, true
+	}
+
+	if t, ok := msg.Value.(Topical); ok {
+		return t.Topic(), true
+	}
+
+	return "", false
+}
+
+// topicTree stores patterns in a radix tree.  A topic is matched by walking
+// its levels, branching on the literal level and the '+' wildcard, and pruning
+// branches that no pattern shares.
+type topicTree struct{ *radix.Tree }
+
+func newTopicTree() topicTree { return topicTree{radix.New()} }
+
+func (t topicTree) match(topic string) bool {
+	return t.search("", strings.Split(topic, "/"))
+}
+
+// search for a pattern that starts with prefix and matches the remaining
+// levels of the topic
+func (t topicTree) search(prefix string, levels []string) bool {
+	if t.has(prefix + "#") {
+		return true
+	}
+
+	branches := []string{levels[0], "+"}
+	if levels[0] == "+" {
+		branches = branches[1:]
+	}
+
+	for _, l := range branches {
+		p := prefix + l
+		if len(levels) == 1 {
+			if t.has(p) || t.has(p+"/#") {
+				return true
+			}
+		} else if t.shares(p+"/") && t.search(p+"/", levels[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t topicTree) has(pattern string) bool {
+	_, ok := t.Get(pattern)
+	return ok
+}
+
+// shares reports whether any pattern starts with prefix
+func (t topicTree) shares(prefix string) (found bool) {
+	t.WalkPrefix(prefix, func(string, interface{}) bool {
+		found = true
+		return true
+	})
+	return
+}
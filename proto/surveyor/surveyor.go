@@ -0,0 +1,203 @@
+package surveyor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lthibault/portal"
+	proto "github.com/lthibault/portal/proto"
+	"github.com/pkg/errors"
+)
+
+// DefaultDeadline is the default duration during which responses to a survey
+// are collected
+const DefaultDeadline = time.Second
+
+// ErrSurveyExpired is returned when receiving from a SURVEYOR portal after the
+// deadline of the current survey, or before any survey has been sent
+var ErrSurveyExpired = errors.New("survey expired")
+
+// Protocol implementing SURVEYOR
+type Protocol struct {
+	ptl portal.ProtocolPortal
+	n   proto.Neighborhood
+
+	sync.RWMutex
+	d        time.Duration
+	survey   uint64    // ID of the current survey
+	deadline time.Time // deadline of the current survey
+}
+
+// Init the protocol (called by portal)
+func (p *Protocol) Init(ptl portal.ProtocolPortal) {
+	p.ptl = ptl
+	p.n = proto.NewNeighborhood()
+	go p.startSending()
+}
+
+// Intake discards responses to previous surveys, as well as responses received
+// after the deadline of the current survey
+func (p *Protocol) Intake(in <-chan *portal.Message) { go p.startReceiving(in) }
+
+// SendHook starts a new survey each time a question is sent
+func (p *Protocol) SendHook(msg *portal.Message) bool {
+	p.Lock()
+	p.survey = msg.ID
+	p.deadline = time.Now().Add(p.d)
+	p.Unlock()
+	return true
+}
+
+// RecvHook discards responses to previous surveys that were still queued when
+// a new survey was started
+func (p *Protocol) RecvHook(msg *portal.Message) bool {
+	survey, _ := p.current()
+	return msg.ReplyTo == survey
+}
+
+func (p *Protocol) current() (survey uint64, deadline time.Time) {
+	p.RLock()
+	defer p.RUnlock()
+	return p.survey, p.deadline
+}
+
+// SetDeadline sets the duration during which responses to subsequent surveys
+// are collected
+func (p *Protocol) SetDeadline(d time.Duration) {
+	p.Lock()
+	p.d = d
+	p.Unlock()
+}
+
+func (p *Protocol) startSending() {
+	sq := p.ptl.SendChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-sq:
+			m, done := p.n.RMap()
+			for _, peer := range m {
+				go proto.Deliver(peer, msg.Ref(), cq)
+			}
+			done()
+
+			msg.Free()
+		}
+	}
+}
+
+func (p *Protocol) startReceiving(in <-chan *portal.Message) {
+	rq := p.ptl.RecvChannel()
+	cq := p.ptl.CloseChannel()
+
+	for {
+		select {
+		case <-cq:
+			return
+		case msg := <-in:
+			survey, deadline := p.current()
+			if msg.ReplyTo != survey || time.Now().After(deadline) {
+				msg.Free() // late reply
+				continue
+			}
+
+			select {
+			case rq <- msg:
+			case <-cq:
+				msg.Free()
+				return
+			}
+		}
+	}
+}
+
+func (p *Protocol) AddEndpoint(ep portal.Endpoint) {
+	proto.MustBeCompatible(p, ep.Signature())
+	p.n.SetPeer(ep.ID(), ep)
+}
+
+func (p *Protocol) RemoveEndpoint(ep portal.Endpoint) { p.n.DropPeer(ep.ID()) }
+
+func (*Protocol) Number() uint16     { return proto.Surv }
+func (*Protocol) PeerNumber() uint16 { return proto.Resp }
+func (*Protocol) Name() string       { return "surveyor" }
+func (*Protocol) PeerName() string   { return "respondent" }
+
+// Portal is a SURVEYOR portal.  Each call to Send starts a new survey, which
+// is broadcast to all connected RESPONDENT portals.  Subsequent calls to Recv
+// return the responses to that survey until its deadline expires, after which
+// Recv returns nil (RecvErr, RecvCtx and RecvEnvelope return ErrSurveyExpired).
+type Portal interface {
+	portal.Portal
+
+	// SetDeadline sets the duration during which responses to subsequent
+	// surveys are collected.  It defaults to DefaultDeadline.
+	SetDeadline(time.Duration)
+}
+
+type surveyor struct {
+	portal.Portal
+	*Protocol
+}
+
+// ctx returns a context that expires with the current survey.  It returns
+// ErrSurveyExpired if the survey has already expired.
+func (s surveyor) ctx(c context.Context) (context.Context, context.CancelFunc, error) {
+	_, deadline := s.current()
+	if !time.Now().Before(deadline) {
+		return nil, nil, ErrSurveyExpired
+	}
+
+	sc, cancel := context.WithDeadline(c, deadline)
+	return sc, cancel, nil
+}
+
+// expired translates the expiry of the survey's deadline into ErrSurveyExpired
+func (s surveyor) expired(c context.Context, err error) error {
+	if err == context.DeadlineExceeded && c.Err() == nil {
+		return ErrSurveyExpired
+	}
+	return err
+}
+
+func (s surveyor) Recv() (v interface{}) {
+	var err error
+	if v, err = s.RecvErr(); err == portal.ErrNotConnected {
+		panic(err)
+	}
+	return
+}
+
+func (s surveyor) RecvErr() (interface{}, error) { return s.RecvCtx(context.Background()) }
+
+func (s surveyor) RecvCtx(c context.Context) (interface{}, error) {
+	sc, cancel, err := s.ctx(c)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	v, err := s.Portal.RecvCtx(sc)
+	return v, s.expired(c, err)
+}
+
+func (s surveyor) RecvEnvelope(c context.Context) (portal.Envelope, error) {
+	sc, cancel, err := s.ctx(c)
+	if err != nil {
+		return portal.Envelope{}, err
+	}
+	defer cancel()
+
+	env, err := s.Portal.RecvEnvelope(sc)
+	return env, s.expired(c, err)
+}
+
+// New allocates a portal using the SURVEYOR protocol
+func New(cfg portal.Cfg) Portal {
+	p := &Protocol{d: DefaultDeadline}
+	return surveyor{Portal: portal.MakePortal(cfg, p), Protocol: p}
+}
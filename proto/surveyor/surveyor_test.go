@@ -0,0 +1,94 @@
+package surveyor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/respondent"
+)
+
+func TestIntegration(t *testing.T) {
+	const nResp = 3
+
+	s := New(portal.Cfg{})
+	s.SetDeadline(time.Millisecond * 50)
+
+	if err := s.Bind("/test/surveyor/integration"); err != nil {
+		t.Error(err)
+	}
+
+	resps := make([]portal.Portal, nResp)
+	for i := range resps {
+		resps[i] = respondent.New(portal.Cfg{})
+		if err := resps[i].Connect("/test/surveyor/integration"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Run("NoSurvey", func(t *testing.T) {
+		if _, err := s.RecvErr(); err != ErrSurveyExpired {
+			t.Errorf("expected %s, got %v", ErrSurveyExpired, err)
+		}
+	})
+
+	t.Run("Survey", func(t *testing.T) {
+		for _, r := range resps {
+			go func(r portal.Portal) {
+				r.Send(r.Recv().(int) + 1)
+				r.Send(-1) // second response MUST be dropped
+			}(r)
+		}
+
+		s.Send(1)
+
+		for i := 0; i < nResp; i++ {
+			if v, err := s.RecvErr(); err != nil {
+				t.Errorf("response %d: %s", i, err)
+			} else if v.(int) != 2 {
+				t.Errorf("unexpected response (expected 2, got %v)", v)
+			}
+		}
+
+		if v, err := s.RecvErr(); err != ErrSurveyExpired {
+			t.Errorf("expected %s, got %v (%v)", ErrSurveyExpired, err, v)
+		}
+	})
+
+	t.Run("LateResponse", func(t *testing.T) {
+		ch := make(chan struct{})
+		go func() {
+			r := resps[0]
+			r.Recv()
+			<-ch // respond after the deadline
+			r.Send(0)
+		}()
+
+		for _, r := range resps[1:] {
+			go func(r portal.Portal) { r.Send(r.Recv()) }(r)
+		}
+
+		s.Send(1)
+		time.Sleep(time.Millisecond * 60)
+		close(ch)
+
+		if _, err := s.RecvErr(); err != ErrSurveyExpired {
+			t.Errorf("expected %s, got %v", ErrSurveyExpired, err)
+		}
+
+		// start a new survey; the late response MUST NOT be delivered
+		for _, r := range resps {
+			go func(r portal.Portal) { r.Send(r.Recv().(int) * 10) }(r)
+		}
+
+		s.Send(2)
+
+		for i := 0; i < nResp; i++ {
+			if v, err := s.RecvErr(); err != nil {
+				t.Errorf("response %d: %s", i, err)
+			} else if v.(int) != 20 {
+				t.Errorf("unexpected response (expected 20, got %v)", v)
+			}
+		}
+	})
+}
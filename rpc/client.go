@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/req"
+	"github.com/pkg/errors"
+)
+
+// Call is the request sent to a Server
+type Call struct {
+	Method string // "Service.Method"
+	Args   interface{}
+}
+
+// Reply is the response returned by a Server.  Err is the error returned by
+// the method, unmodified, so that callers can inspect it with errors.Cause.
+type Reply struct {
+	Value interface{}
+	Err   error
+}
+
+// Client calls the methods of a remote Server
+type Client struct{ req.Portal }
+
+// NewClient wraps a REQ portal
+func NewClient(p req.Portal) *Client { return &Client{Portal: p} }
+
+// Dial returns a client connected to the server bound to addr
+func Dial(addr string) (*Client, error) {
+	p := req.New(portal.Cfg{})
+	if err := p.Connect(addr); err != nil {
+		return nil, err
+	}
+	return NewClient(p), nil
+}
+
+// Call the named method ("Service.Method") with the given arguments, and wait
+// for its reply.  The returned error is the error returned by the method, if
+// any, a *rep.PanicError if the method panicked, or an error that occurred
+// while transmitting the call.
+func (c *Client) Call(ctx context.Context, method string, args interface{}) (interface{}, error) {
+	v, err := c.Request(ctx, Call{Method: method, Args: args})
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := v.(type) {
+	case Reply:
+		return r.Value, r.Err
+	default:
+		return nil, errors.Wrapf(portal.ErrType, "expected rpc.Reply, got %T", v)
+	}
+}
+
+// CallOf is a type-safe variant of Client.Call
+func CallOf[R any](ctx context.Context, c *Client, method string, args interface{}) (r R, err error) {
+	var v interface{}
+	if v, err = c.Call(ctx, method, args); err != nil || v == nil {
+		return
+	}
+
+	var ok bool
+	if r, ok = v.(R); !ok {
+		err = errors.Wrapf(portal.ErrType, "expected %T, got %T", r, v)
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lthibault/portal"
+	"github.com/pkg/errors"
+)
+
+var errDivZero = errors.New("division by zero")
+
+type Pair struct{ A, B int }
+
+type Arith struct{}
+
+func (Arith) Add(p Pair) (int, error) { return p.A + p.B, nil }
+
+func (Arith) Div(_ context.Context, p Pair) (int, error) {
+	if p.B == 0 {
+		return 0, errDivZero
+	}
+	return p.A / p.B, nil
+}
+
+func (Arith) unexported(p Pair) (int, error) { return 0, nil }
+
+func TestRPC(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Register(struct{}{}); errors.Cause(err) != ErrNoMethods {
+		t.Errorf("expected %s, got %v", ErrNoMethods, err)
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	go s.Serve(c, "/test/rpc")
+
+	var (
+		cl  *Client
+		err error
+	)
+	for cl, err = Dial("/test/rpc"); err != nil; cl, err = Dial("/test/rpc") {
+		if errors.Cause(err) != portal.ErrUnboundAddr {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Run("Call", func(t *testing.T) {
+		if v, err := cl.Call(c, "Arith.Add", Pair{1, 2}); err != nil {
+			t.Error(err)
+		} else if v.(int) != 3 {
+			t.Errorf("unexpected reply (expected 3, got %v)", v)
+		}
+	})
+
+	t.Run("CallOf", func(t *testing.T) {
+		if v, err := CallOf[int](c, cl, "Arith.Div", Pair{6, 2}); err != nil {
+			t.Error(err)
+		} else if v != 3 {
+			t.Errorf("unexpected reply (expected 3, got %d)", v)
+		}
+	})
+
+	t.Run("MethodError", func(t *testing.T) {
+		if _, err := cl.Call(c, "Arith.Div", Pair{1, 0}); err != errDivZero {
+			t.Errorf("expected %s, got %v", errDivZero, err)
+		}
+	})
+
+	t.Run("UnknownMethod", func(t *testing.T) {
+		for _, m := range []string{"Arith.Mul", "Arith.unexported"} {
+			if _, err := cl.Call(c, m, Pair{}); errors.Cause(err) != ErrUnknownMethod {
+				t.Errorf("%s: expected %s, got %v", m, ErrUnknownMethod, err)
+			}
+		}
+	})
+
+	t.Run("BadArgs", func(t *testing.T) {
+		if _, err := cl.Call(c, "Arith.Add", "foo"); errors.Cause(err) != portal.ErrType {
+			t.Errorf("expected %s, got %v", portal.ErrType, err)
+		}
+	})
+}
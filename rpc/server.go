@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/lthibault/portal"
+	"github.com/lthibault/portal/proto/rep"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnknownMethod is returned when calling a method that is not registered
+	ErrUnknownMethod = errors.New("unknown method")
+
+	// ErrNoMethods is returned when registering a receiver that has no
+	// suitable methods
+	ErrNoMethods = errors.New("no suitable methods")
+
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// method is a registered method
+type method struct {
+	fn      reflect.Value
+	args    reflect.Type
+	withCtx bool
+}
+
+// call the method, converting its arguments
+func (m method) call(c context.Context, args interface{}) (interface{}, error) {
+	a := reflect.Zero(m.args)
+	if args != nil {
+		if a = reflect.ValueOf(args); !a.Type().AssignableTo(m.args) {
+			return nil, errors.Wrapf(portal.ErrType, "expected %s, got %T", m.args, args)
+		}
+	}
+
+	in := []reflect.Value{a}
+	if m.withCtx {
+		in = []reflect.Value{reflect.ValueOf(c), a}
+	}
+
+	out := m.fn.Call(in)
+
+	err, _ := out[1].Interface().(error)
+	return out[0].Interface(), err
+}
+
+// suitable reports whether a method can be called remotely.  Suitable methods
+// are exported, and have the form
+//
+//	func (t *T) Name([context.Context,] A) (R, error)
+func suitable(m reflect.Method) (method, bool) {
+	t := m.Type // includes the receiver
+	if m.PkgPath != "" || t.NumOut() != 2 || t.Out(1) != typeOfError {
+		return method{}, false
+	}
+
+	switch {
+	case t.NumIn() == 2:
+		return method{args: t.In(1)}, true
+	case t.NumIn() == 3 && t.In(1) == typeOfContext:
+		return method{args: t.In(2), withCtx: true}, true
+	}
+
+	return method{}, false
+}
+
+// Server dispatches calls to the methods of registered receivers.  It
+// implements rep.Handler.
+type Server struct {
+	sync.RWMutex
+	methods map[string]method
+}
+
+// NewServer returns a server with no registered receivers
+func NewServer() *Server { return &Server{methods: make(map[string]method)} }
+
+// Register the suitable methods of the receiver under the name of its
+// concrete type.  See RegisterName.
+func (s *Server) Register(rcvr interface{}) error {
+	return s.RegisterName(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+// RegisterName registers the suitable methods of the receiver, such that each
+// method M can be called as "name.M".  Suitable methods are exported, and
+// have the form
+//
+//	func (t *T) M([context.Context,] A) (R, error)
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	v := reflect.ValueOf(rcvr)
+
+	ms := make(map[string]method)
+	for i := 0; i < v.NumMethod(); i++ {
+		if m, ok := suitable(v.Type().Method(i)); ok {
+			m.fn = v.Method(i)
+			ms[name+"."+v.Type().Method(i).Name] = m
+		}
+	}
+
+	if len(ms) == 0 {
+		return errors.Wrap(ErrNoMethods, name)
+	}
+
+	s.Lock()
+	for n, m := range ms {
+		s.methods[n] = m
+	}
+	s.Unlock()
+
+	return nil
+}
+
+// ServeRequest dispatches a Call to the corresponding method, and returns a
+// Reply
+func (s *Server) ServeRequest(c context.Context, v interface{}) interface{} {
+	call, ok := v.(Call)
+	if !ok {
+		return Reply{Err: errors.Wrapf(portal.ErrType, "expected rpc.Call, got %T", v)}
+	}
+
+	s.RLock()
+	m, ok := s.methods[call.Method]
+	s.RUnlock()
+
+	if !ok {
+		return Reply{Err: errors.Wrap(ErrUnknownMethod, call.Method)}
+	}
+
+	value, err := m.call(c, call.Args)
+	return Reply{Value: value, Err: err}
+}
+
+// Serve binds to addr and serves calls until the context expires.  See
+// rep.Server.
+func (s *Server) Serve(c context.Context, addr string) error {
+	return rep.Serve(c, addr, s)
+}
@@ -0,0 +1,121 @@
+package portal
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// ErrType is returned when a typed portal receives a value of an unexpected
+// type, e.g. from an untyped Portal connected to the same address.
+var ErrType = errors.New("unexpected type")
+
+func assertType[T any](v interface{}) (t T, err error) {
+	if v == nil {
+		return // zero value
+	}
+
+	var ok bool
+	if t, ok = v.(T); !ok {
+		err = errors.Wrapf(ErrType, "expected %s, got %T", reflect.TypeOf((*T)(nil)).Elem(), v)
+	}
+
+	return
+}
+
+func mustType[T any](v interface{}) T {
+	t, err := assertType[T](v)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Typed is a type-safe Portal.  It is a generic implementation of the type
+// guard pattern, and interoperates with untyped portals through the embedded
+// Portal.
+type Typed[T any] struct{ Portal }
+
+// Send a value of type T
+func (t Typed[T]) Send(v T) { t.Portal.Send(v) }
+
+// SendErr is the typed equivalent of Portal.SendErr
+func (t Typed[T]) SendErr(v T) error { return t.Portal.SendErr(v) }
+
+// SendCtx is the typed equivalent of Portal.SendCtx
+func (t Typed[T]) SendCtx(c context.Context, v T) error { return t.Portal.SendCtx(c, v) }
+
+// TrySend is the typed equivalent of Portal.TrySend
+func (t Typed[T]) TrySend(v T) bool { return t.Portal.TrySend(v) }
+
+// TryRecv is the typed equivalent of Portal.TryRecv.  It panics if the value is
+// of a different type.
+func (t Typed[T]) TryRecv() (v T, ok bool) {
+	var u interface{}
+	if u, ok = t.Portal.TryRecv(); ok {
+		v = mustType[T](u)
+	}
+	return
+}
+
+// Recv a value of type T.  It panics if the value is of a different type.
+func (t Typed[T]) Recv() T { return mustType[T](t.Portal.Recv()) }
+
+// RecvErr is the typed equivalent of Portal.RecvErr.  It returns ErrType if
+// the value is of a different type.
+func (t Typed[T]) RecvErr() (T, error) { return recvTyped[T](t.Portal.RecvErr()) }
+
+// RecvCtx is the typed equivalent of Portal.RecvCtx.  It returns ErrType if
+// the value is of a different type.
+func (t Typed[T]) RecvCtx(c context.Context) (T, error) {
+	return recvTyped[T](t.Portal.RecvCtx(c))
+}
+
+// TypedReadOnly is a type-safe ReadOnly portal
+type TypedReadOnly[T any] struct{ ReadOnly }
+
+// Recv a value of type T.  It panics if the value is of a different type.
+func (t TypedReadOnly[T]) Recv() T { return mustType[T](t.ReadOnly.Recv()) }
+
+// TryRecv is the typed equivalent of ReadOnly.TryRecv.  It panics if the value
+// is of a different type.
+func (t TypedReadOnly[T]) TryRecv() (v T, ok bool) {
+	var u interface{}
+	if u, ok = t.ReadOnly.TryRecv(); ok {
+		v = mustType[T](u)
+	}
+	return
+}
+
+// RecvErr is the typed equivalent of ReadOnly.RecvErr
+func (t TypedReadOnly[T]) RecvErr() (T, error) { return recvTyped[T](t.ReadOnly.RecvErr()) }
+
+// RecvCtx is the typed equivalent of ReadOnly.RecvCtx
+func (t TypedReadOnly[T]) RecvCtx(c context.Context) (T, error) {
+	return recvTyped[T](t.ReadOnly.RecvCtx(c))
+}
+
+// TypedWriteOnly is a type-safe WriteOnly portal
+type TypedWriteOnly[T any] struct{ WriteOnly }
+
+// Send a value of type T
+func (t TypedWriteOnly[T]) Send(v T) { t.WriteOnly.Send(v) }
+
+// TrySend is the typed equivalent of WriteOnly.TrySend
+func (t TypedWriteOnly[T]) TrySend(v T) bool { return t.WriteOnly.TrySend(v) }
+
+// SendErr is the typed equivalent of WriteOnly.SendErr
+func (t TypedWriteOnly[T]) SendErr(v T) error { return t.WriteOnly.SendErr(v) }
+
+// SendCtx is the typed equivalent of WriteOnly.SendCtx
+func (t TypedWriteOnly[T]) SendCtx(c context.Context, v T) error {
+	return t.WriteOnly.SendCtx(c, v)
+}
+
+func recvTyped[T any](v interface{}, err error) (t T, _ error) {
+	if err != nil {
+		return t, err
+	}
+	return assertType[T](v)
+}
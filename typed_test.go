@@ -0,0 +1,65 @@
+package portal
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTyped(t *testing.T) {
+	p := mockProtoExt{
+		onSend: func(*Message) bool { return true },
+		onRecv: func(*Message) bool { return true },
+	}
+
+	ptl, _ := mkSendRecvTestPortal(p, 1)
+	if err := ptl.Bind("/kilo"); err != nil {
+		t.Errorf("failed to bind: %s", err)
+	}
+	defer ptl.Close()
+
+	tp := Typed[int]{Portal: ptl}
+
+	t.Run("Send", func(t *testing.T) {
+		tp.Send(1)
+
+		msg := <-ptl.chSend
+		defer msg.Free()
+
+		if v, ok := msg.Value.(int); !ok || v != 1 {
+			t.Errorf("unexpected value in message (expected 1, got %v)", msg.Value)
+		}
+	})
+
+	t.Run("Recv", func(t *testing.T) {
+		m := NewMsg()
+		m.Value = 2
+		ptl.chRecv <- m
+
+		if v := tp.Recv(); v != 2 {
+			t.Errorf("unexpected value (expected 2, got %d)", v)
+		}
+	})
+
+	t.Run("RecvNil", func(t *testing.T) {
+		m := NewMsg()
+		m.Value = nil // pooled messages may hold a stale value
+		ptl.chRecv <- m
+
+		if v, err := tp.RecvErr(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if v != 0 {
+			t.Errorf("expected zero value, got %d", v)
+		}
+	})
+
+	t.Run("RecvWrongType", func(t *testing.T) {
+		m := NewMsg()
+		m.Value = "three"
+		ptl.chRecv <- m
+
+		if _, err := tp.RecvErr(); errors.Cause(err) != ErrType {
+			t.Errorf("expected %s, got %v", ErrType, err)
+		}
+	})
+}